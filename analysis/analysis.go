@@ -1,6 +1,7 @@
 package analysis
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/laindream/go-callflow-vis/cache"
@@ -8,8 +9,10 @@ import (
 	"github.com/laindream/go-callflow-vis/flow"
 	"github.com/laindream/go-callflow-vis/ir"
 	"github.com/laindream/go-callflow-vis/log"
-	"github.com/laindream/go-callflow-vis/util"
+	"github.com/laindream/go-callflow-vis/plugin"
+	"github.com/laindream/go-callflow-vis/progress"
 	"golang.org/x/tools/go/callgraph"
+	"io"
 )
 
 type CallgraphType string
@@ -24,12 +27,21 @@ const (
 
 type Analysis struct {
 	*ProgramAnalysisParam
-	callgraph *ir.Callgraph
-	config    *config.Config
-	flow      *flow.Flow
-	cachePath string
-	cache     *cache.FileCache
-	fastMode  bool
+	callgraph   *ir.Callgraph
+	config      *config.Config
+	flow        *flow.Flow
+	cachePath   string
+	cache       cache.Cache
+	fastMode    bool
+	maxRounds   int
+	parallel    int
+	lowMemory   bool
+	keys        *stageKeys
+	sourcesHash map[string]string
+	sources     *sourceHasher
+	modules     []*localModule
+	// minGraph is set by a min graph cache hit, the flow is then created on it
+	minGraph *ir.Callgraph
 }
 
 type ProgramAnalysisParam struct {
@@ -38,56 +50,108 @@ type ProgramAnalysisParam struct {
 	Dir   string        `json:"dir"`
 	Args  []string      `json:"args"`
 	Build []string      `json:"build"`
+	// Dirs and Workspace are set for multi-module analysis, Dir is left empty then
+	Dirs      []string `json:"dirs,omitempty"`
+	Workspace string   `json:"workspace,omitempty"`
+	// Plugins only takes part in the cache key when set, keeping existing cache entries valid
+	Plugins      []string `json:"plugins,omitempty"`
+	AllowErrors  bool     `json:"allow_errors,omitempty"`
+	FoldClosures bool     `json:"fold_closures,omitempty"`
+	// Builds is the build matrix from config, the program is analyzed once per build
+	Builds []*config.Build `json:"builds,omitempty"`
 }
 
 func NewAnalysis(
 	config *config.Config,
-	cachePath string,
+	cache cache.Cache,
 	algo CallgraphType,
 	tests bool,
-	dir string,
+	dirs []string,
+	workspace string,
 	args []string,
 	build []string,
-	fastMode bool) *Analysis {
+	plugins []string,
+	allowErrors bool,
+	foldClosures bool,
+	fastMode bool,
+	maxRounds int,
+	parallel int,
+	lowMemory bool) *Analysis {
 	if config == nil {
 		fmt.Printf("Analysis.NewAnalysis: config is nil\n")
 		return nil
 	}
+	var dir string
+	if len(dirs) == 1 && workspace == "" {
+		dir = dirs[0]
+		dirs = nil
+	}
 	return &Analysis{
-		config:   config,
-		cache:    cache.NewFileCache(cachePath),
-		fastMode: fastMode,
+		config:    config,
+		cache:     cache,
+		fastMode:  fastMode,
+		maxRounds: maxRounds,
+		parallel:  parallel,
+		lowMemory: lowMemory,
 		ProgramAnalysisParam: &ProgramAnalysisParam{
-			Algo:  algo,
-			Tests: tests,
-			Dir:   dir,
-			Args:  args,
-			Build: build,
+			Algo:         algo,
+			Tests:        tests,
+			Dir:          dir,
+			Dirs:         dirs,
+			Workspace:    workspace,
+			Args:         args,
+			Build:        build,
+			Plugins:      plugins,
+			AllowErrors:  allowErrors,
+			FoldClosures: foldClosures,
+			Builds:       config.Builds,
 		},
 	}
 }
 
-func (a *Analysis) Run() error {
-	filterCacheKey := fmt.Sprintf("%s_filter_%s", a.GetCacheKeyPrefix(), util.GetHash(a.config))
-	var filterCacheObj *ir.Callgraph
-	err := a.cache.Get(filterCacheKey, &filterCacheObj)
-	if err == nil && filterCacheObj != nil {
-		log.GetLogger().Debugf("Analysis.Run: cache hit: %s", filterCacheKey)
-		a.callgraph = filterCacheObj
+// Run builds, filters and caches the callgraph and generates the flow, starting from the last
+// cached stage, see stageKeys. When ctx is done, it returns the context error without caching the
+// stage it was interrupted in, the stages finished before are cached.
+func (a *Analysis) Run(ctx context.Context) error {
+	keys := a.getStageKeys()
+	var f *flow.Flow
+	err := a.cache.GetStream(keys.Flow, func(r io.Reader) (err error) {
+		f, err = flow.NewFlowFromResult(a.config, r)
+		return err
+	})
+	if err == nil {
+		log.GetLogger().Debugf("Analysis.Run: cache hit: %s", keys.Flow)
+		a.flow = f
+		return nil
 	}
-	if a.callgraph == nil {
-		err = a.InitCallgraph()
+	var minGraph *ir.Callgraph
+	err = a.cache.Get(keys.Min, &minGraph)
+	if err == nil && minGraph != nil {
+		log.GetLogger().Debugf("Analysis.Run: cache hit: %s", keys.Min)
+		a.minGraph = minGraph
+	}
+	if a.minGraph == nil {
+		var filterCacheObj *ir.Callgraph
+		err = a.cache.Get(keys.Filtered, &filterCacheObj)
+		if err == nil && filterCacheObj != nil {
+			log.GetLogger().Debugf("Analysis.Run: cache hit: %s", keys.Filtered)
+			a.callgraph = filterCacheObj
+		}
+	}
+	if a.minGraph == nil && a.callgraph == nil {
+		err = a.InitCallgraph(ctx)
 		if err != nil {
 			log.GetLogger().Errorf("Analysis.Run: init callgraph error: %v", err)
 			return err
 		}
-		err = a.FilterCallGraph()
+		// the filtered cache was missed above
+		err = a.filterCallGraph(ctx)
 		if err != nil {
 			log.GetLogger().Errorf("Analysis.Run: filter callgraph error: %v", err)
 			return err
 		}
 	}
-	err = a.GenerateFlow()
+	err = a.GenerateFlow(ctx)
 	if err != nil {
 		log.GetLogger().Errorf("Analysis.Run: generate flow error: %v", err)
 		return err
@@ -95,8 +159,8 @@ func (a *Analysis) Run() error {
 	return nil
 }
 
-func (a *Analysis) InitCallgraph() error {
-	cacheKey := a.GetCacheKeyPrefix()
+func (a *Analysis) InitCallgraph(ctx context.Context) error {
+	cacheKey := a.getStageKeys().Raw
 	var cacheObj *ir.Callgraph
 	err := a.cache.Get(cacheKey, &cacheObj)
 	if err == nil && cacheObj != nil {
@@ -104,62 +168,190 @@ func (a *Analysis) InitCallgraph() error {
 		a.callgraph = cacheObj
 		return nil
 	}
-	log.GetLogger().Debugf("Analysis.InitCallgraph: Program Analysis Start...")
-	programAnalysis, err := RunAnalysis(a.Tests, a.Build, a.Args, a.Dir)
-	if err != nil {
-		log.GetLogger().Errorf("Analysis.InitCallgraph: program analysis error: %v", err)
-		return err
+	if len(a.Builds) == 0 {
+		a.callgraph, err = a.buildCallgraph(ctx, nil, a.Build)
+		if err != nil {
+			return err
+		}
 	}
-	var cg *callgraph.Graph
-	log.GetLogger().Debugf("Analysis.InitCallgraph: Callgraph Compute Start(algo:%s)...", a.Algo)
-	cg, err = a.ComputeCallgraph(programAnalysis)
-	if err != nil {
-		log.GetLogger().Errorf("Analysis.InitCallgraph: callgraph compute error: %v", err)
+	for _, b := range a.Builds {
+		log.GetLogger().Debugf("Analysis.InitCallgraph: Build %s Start(env:%v, flags:%v)...", b.Name, b.GetEnv(), b.GetBuildFlags())
+		progress.GetTracker().SetScope(b.Name)
+		cg, err := a.buildCallgraph(ctx, b.GetEnv(), append(append([]string{}, a.Build...), b.GetBuildFlags()...))
+		progress.GetTracker().SetScope("")
+		if err != nil {
+			log.GetLogger().Errorf("Analysis.InitCallgraph: build %s error: %v", b.Name, err)
+			return err
+		}
+		cg.SetConfig(b.Name)
+		if a.callgraph == nil {
+			a.callgraph = cg
+			continue
+		}
+		log.GetLogger().Debugf("Analysis.InitCallgraph: Callgraph Merge Start(build:%s)...", b.Name)
+		mergePhase := progress.GetTracker().Start(progress.PhaseMerge)
+		a.callgraph.Merge(cg)
+		mergePhase.Done(len(a.callgraph.Nodes))
+	}
+	if err = ctx.Err(); err != nil {
 		return err
 	}
-	log.GetLogger().Debugf("Analysis.InitCallgraph: Callgraph Convert Start...")
-	cg.DeleteSyntheticNodes()
-	a.callgraph = ir.ConvertToIR(cg)
 	log.GetLogger().Debugf("Analysis.InitCallgraph: cache set: %s", cacheKey)
-	err = a.cache.Set(cacheKey, a.callgraph)
+	err = a.cache.Set(cacheKey, a.callgraph, a.getStageMeta(stageRaw))
 	if err != nil {
 		log.GetLogger().Errorf("Analysis.InitCallgraph cache set error: %v", err)
 	}
 	return nil
 }
 
+func (a *Analysis) buildCallgraph(ctx context.Context, env []string, buildFlags []string) (*ir.Callgraph, error) {
+	log.GetLogger().Debugf("Analysis.buildCallgraph: Program Analysis Start...")
+	programAnalysis, err := RunAnalysis(ctx, a.Tests, buildFlags, a.Args, a.GetQueryDirs(), a.Workspace, a.AllowErrors, env)
+	if err != nil {
+		log.GetLogger().Errorf("Analysis.buildCallgraph: program analysis error: %v", err)
+		return nil, err
+	}
+	var cg *callgraph.Graph
+	log.GetLogger().Debugf("Analysis.buildCallgraph: Callgraph Compute Start(algo:%s)...", a.Algo)
+	callgraphPhase := progress.GetTracker().Start(progress.PhaseCallgraph)
+	cg, err = a.ComputeCallgraph(ctx, programAnalysis)
+	if err != nil {
+		log.GetLogger().Errorf("Analysis.buildCallgraph: callgraph compute error: %v", err)
+		return nil, err
+	}
+	callgraphPhase.Done(len(cg.Nodes))
+	log.GetLogger().Debugf("Analysis.buildCallgraph: Callgraph Convert Start...")
+	convertPhase := progress.GetTracker().Start(progress.PhaseConvert)
+	deleteSyntheticNodes(cg)
+	callgraphIR := ir.ConvertToIR(cg, a.FoldClosures)
+	convertPhase.Done(len(callgraphIR.Nodes))
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	callgraphIR.Unanalyzed = programAnalysis.Unanalyzed
+	if len(callgraphIR.Unanalyzed) > 0 {
+		log.GetLogger().Warnf("%d packages unanalyzed because of errors, edges through them are missing", len(callgraphIR.Unanalyzed))
+	}
+	if len(a.Plugins) > 0 {
+		log.GetLogger().Debugf("Analysis.buildCallgraph: Plugins Apply Start(plugins:%v)...", a.Plugins)
+		pluginsPhase := progress.GetTracker().Start(progress.PhasePlugins)
+		plugins, err := plugin.GetPlugins(a.Plugins)
+		if err != nil {
+			log.GetLogger().Errorf("Analysis.buildCallgraph: get plugins error: %v", err)
+			return nil, err
+		}
+		err = plugin.Apply(plugins, programAnalysis.Prog, callgraphIR)
+		if err != nil {
+			log.GetLogger().Errorf("Analysis.buildCallgraph: plugins apply error: %v", err)
+			return nil, err
+		}
+		pluginsPhase.Done(len(plugins))
+	}
+	return callgraphIR, nil
+}
+
+func (a *Analysis) GetQueryDirs() []string {
+	if len(a.Dirs) > 0 {
+		return a.Dirs
+	}
+	if a.Dir != "" {
+		return []string{a.Dir}
+	}
+	return nil
+}
+
 func (a *Analysis) GetCacheKeyPrefix() string {
-	programAnalysisParamHash := util.GetHash(a.ProgramAnalysisParam)
-	return fmt.Sprintf("%s_%s", "callgraph", programAnalysisParamHash)
+	return a.getStageKeys().Raw
 }
 
-func (a *Analysis) GenerateFlow() error {
-	if a.callgraph == nil {
+func (a *Analysis) GenerateFlow(ctx context.Context) error {
+	if a.callgraph == nil && a.minGraph == nil {
 		return errors.New("callgraph is nil")
 	}
 	if a.config == nil {
 		return errors.New("config is nil")
 	}
-	f, err := flow.NewFlow(a.config, a.callgraph, a.fastMode)
+	keys := a.getStageKeys()
+	var f *flow.Flow
+	var err error
+	if a.minGraph != nil {
+		f, err = flow.NewFlowWithMinGraph(a.config, a.minGraph, a.fastMode, a.maxRounds, a.parallel, a.lowMemory)
+		a.minGraph = nil
+	} else {
+		f, err = flow.NewFlow(ctx, a.config, a.callgraph, a.fastMode, a.maxRounds, a.parallel, a.lowMemory)
+		if err == nil && ctx.Err() == nil {
+			log.GetLogger().Debugf("Analysis.GenerateFlow: cache set: %s", keys.Min)
+			if err := a.cache.Set(keys.Min, f.GetCallgraph(), a.getStageMeta(stageMin)); err != nil {
+				log.GetLogger().Errorf("Analysis.GenerateFlow min graph cache set error: %v", err)
+			}
+		}
+	}
 	if err != nil {
 		log.GetLogger().Errorf("Analysis.GenerateFlow: flow new error: %v", err)
 		return err
 	}
-	err = f.Generate()
+	if a.lowMemory {
+		// the flow works on its min graph, release the filtered callgraph early
+		a.callgraph = nil
+	}
+	err = f.Generate(ctx)
 	if err != nil {
 		log.GetLogger().Errorf("Analysis.GenerateFlow: flow generate error: %v", err)
 		return err
 	}
 	a.flow = f
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	log.GetLogger().Debugf("Analysis.GenerateFlow: cache set: %s", keys.Flow)
+	err = a.cache.SetStream(keys.Flow, a.getStageMeta(stageFlow), f.WriteResult)
+	if err != nil {
+		log.GetLogger().Errorf("Analysis.GenerateFlow flow cache set error: %v", err)
+	}
 	return nil
 }
 
+// Explain writes what the focus and ignore rules and the entities match, see flow.Explain. It
+// works on the cached filtered callgraph, and on the raw one for the rules if it is cached too,
+// building them on a miss. No flow is generated.
+func (a *Analysis) Explain(ctx context.Context, w io.Writer, limit int) error {
+	keys := a.getStageKeys()
+	var rawGraph, filteredGraph *ir.Callgraph
+	err := a.cache.Get(keys.Filtered, &filteredGraph)
+	if err == nil && filteredGraph != nil {
+		log.GetLogger().Debugf("Analysis.Explain: cache hit: %s", keys.Filtered)
+		err = a.cache.Get(keys.Raw, &rawGraph)
+		if err == nil && rawGraph != nil {
+			log.GetLogger().Debugf("Analysis.Explain: cache hit: %s", keys.Raw)
+		}
+	} else {
+		err = a.InitCallgraph(ctx)
+		if err != nil {
+			log.GetLogger().Errorf("Analysis.Explain: init callgraph error: %v", err)
+			return err
+		}
+		rawGraph = a.callgraph
+		err = a.filterCallGraph(ctx)
+		if err != nil {
+			log.GetLogger().Errorf("Analysis.Explain: filter callgraph error: %v", err)
+			return err
+		}
+		filteredGraph = a.callgraph
+	}
+	return flow.Explain(w, a.config, rawGraph, filteredGraph, limit)
+}
+
+// GetCallgraph returns the callgraph of the last stage run, e.g. the raw one after InitCallgraph.
+func (a *Analysis) GetCallgraph() *ir.Callgraph {
+	return a.callgraph
+}
+
 func (a *Analysis) GetFlow() *flow.Flow {
 	return a.flow
 }
 
-func (a *Analysis) FilterCallGraph() error {
-	cacheKey := fmt.Sprintf("%s_filter_%s", a.GetCacheKeyPrefix(), util.GetHash(a.config))
+func (a *Analysis) FilterCallGraph(ctx context.Context) error {
+	cacheKey := a.getStageKeys().Filtered
 	var cacheObj *ir.Callgraph
 	err := a.cache.Get(cacheKey, &cacheObj)
 	if err == nil && cacheObj != nil {
@@ -167,10 +359,16 @@ func (a *Analysis) FilterCallGraph() error {
 		a.callgraph = cacheObj
 		return nil
 	}
+	return a.filterCallGraph(ctx)
+}
+
+func (a *Analysis) filterCallGraph(ctx context.Context) error {
+	cacheKey := a.getStageKeys().Filtered
 	if a.callgraph == nil {
 		return errors.New("callgraph is nil")
 	}
 	log.GetLogger().Debugf("Analysis.FilterCallGraph: Filter Callgraph Start...")
+	filterPhase := progress.GetTracker().Start(progress.PhaseFilter)
 	a.callgraph = ir.GetFilteredCallgraph(a.callgraph, func(funcName string) bool {
 		if (len(a.config.Focus) != 0 && !a.config.Focus.Match(funcName)) ||
 			(len(a.config.Ignore) != 0 && a.config.Ignore.Match(funcName)) {
@@ -178,8 +376,12 @@ func (a *Analysis) FilterCallGraph() error {
 		}
 		return true
 	})
+	filterPhase.Done(len(a.callgraph.Nodes))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	log.GetLogger().Debugf("Analysis.FilterCallGraph: cache set: %s", cacheKey)
-	err = a.cache.Set(cacheKey, a.callgraph)
+	err := a.cache.Set(cacheKey, a.callgraph, a.getStageMeta(stageFiltered))
 	if err != nil {
 		log.GetLogger().Errorf("Analysis.FilterCallGraph cache set error: %v", err)
 	}
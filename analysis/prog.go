@@ -1,9 +1,13 @@
 package analysis
 
 import (
+	"context"
 	"fmt"
+	"github.com/laindream/go-callflow-vis/progress"
 	"go/build"
 	"golang.org/x/tools/go/callgraph/vta"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"golang.org/x/tools/go/callgraph"
@@ -19,6 +23,8 @@ type ProgramAnalysis struct {
 	Prog  *ssa.Program
 	Pkgs  []*ssa.Package
 	Mains []*ssa.Package
+	// Unanalyzed maps the packages without SSA because of errors to the reason
+	Unanalyzed map[string]string
 }
 
 const pkgLoadMode = packages.NeedName |
@@ -49,7 +55,20 @@ func getBuildFlagTags(buildTags []string) string {
 	return ""
 }
 
-func RunAnalysis(withTests bool, buildFlags []string, pkgPatterns []string, queryDir string) (*ProgramAnalysis, error) {
+// getWorkspaceGoFlags drops -mod from GOFLAGS, which only accepts readonly or vendor in workspace mode.
+func getWorkspaceGoFlags() string {
+	flags := make([]string, 0)
+	for _, f := range strings.Fields(os.Getenv("GOFLAGS")) {
+		if strings.HasPrefix(f, "-mod=") || strings.HasPrefix(f, "--mod=") {
+			continue
+		}
+		flags = append(flags, f)
+	}
+	return strings.Join(flags, " ")
+}
+
+func RunAnalysis(ctx context.Context, withTests bool, buildFlags []string, pkgPatterns []string, queryDirs []string, workFile string,
+	allowErrors bool, env []string) (*ProgramAnalysis, error) {
 	if len(pkgPatterns) == 0 {
 		return nil, fmt.Errorf("no package patterns provided")
 	}
@@ -57,35 +76,103 @@ func RunAnalysis(withTests bool, buildFlags []string, pkgPatterns []string, quer
 		buildFlags = getBuildFlags()
 	}
 	cfg := &packages.Config{
+		Context:    ctx,
 		Mode:       packages.LoadAllSyntax,
 		Tests:      withTests,
 		BuildFlags: buildFlags,
-		Dir:        queryDir,
+	}
+	if len(env) > 0 {
+		cfg.Env = append(os.Environ(), env...)
+	}
+	if len(queryDirs) == 1 && workFile == "" {
+		cfg.Dir = queryDirs[0]
+	}
+	if len(queryDirs) > 1 || workFile != "" {
+		// load all modules at once to get one type universe, so calls across modules are linked
+		ws, err := prepareWorkspace(workFile, queryDirs)
+		if err != nil {
+			return nil, fmt.Errorf("preparing workspace: %v", err)
+		}
+		defer ws.cleanup()
+		cfg.Dir = filepath.Dir(ws.workFile)
+		if cfg.Env == nil {
+			cfg.Env = os.Environ()
+		}
+		cfg.Env = append(cfg.Env, "GOWORK="+ws.workFile, "GOFLAGS="+getWorkspaceGoFlags())
+		pkgPatterns = ws.patterns(pkgPatterns)
 	}
 	//if gopath != "" {
 	//	cfg.Env = append(os.Environ(), "GOPATH="+gopath) // to enable testing
 	//}
+	loadPhase := progress.GetTracker().Start(progress.PhaseLoad)
 	initial, err := packages.Load(cfg, pkgPatterns...)
 	if err != nil {
-		return nil, fmt.Errorf("loading packages: %v", err)
+		if ctx.Err() != nil {
+			// the go command killed by ctx only reports a generic error
+			return nil, fmt.Errorf("loading packages: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("loading packages: %w", err)
 	}
+	pkgCount := 0
+	packages.Visit(initial, nil, func(p *packages.Package) {
+		pkgCount++
+	})
+	loadPhase.Done(pkgCount)
+	var unanalyzed map[string]string
 	if packages.PrintErrors(initial) > 0 {
-		return nil, fmt.Errorf("packages contain errors")
+		if !allowErrors {
+			return nil, fmt.Errorf("packages contain errors")
+		}
+		unanalyzed = getIllTypedPackages(initial)
 	}
 
 	// Create and build SSA-form program representation.
+	// Ill-typed packages and the packages depending on them are skipped by AllPackages.
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	ssaPhase := progress.GetTracker().Start(progress.PhaseSSA)
 	mode := ssa.InstantiateGenerics // instantiate generics by default for soundness
 	prog, pkgs := ssautil.AllPackages(initial, mode)
 	prog.Build()
+	ssaPhase.Done(len(pkgs))
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	return &ProgramAnalysis{
 		Prog: prog,
 		Pkgs: pkgs,
 		//Mains: mains,
+		Unanalyzed: unanalyzed,
 	}, nil
 }
 
-func (a *Analysis) ComputeCallgraph(data *ProgramAnalysis) (*callgraph.Graph, error) {
+func getIllTypedPackages(initial []*packages.Package) map[string]string {
+	illTyped := make(map[string]string)
+	packages.Visit(initial, nil, func(p *packages.Package) {
+		if len(p.Errors) > 0 {
+			illTyped[p.ID] = fmt.Sprintf("%d errors, first: %s", len(p.Errors), p.Errors[0].Error())
+			return
+		}
+		if p.Types == nil || p.IllTyped {
+			for _, imp := range p.Imports {
+				if imp.IllTyped {
+					illTyped[p.ID] = fmt.Sprintf("depends on unanalyzed package %s", imp.ID)
+					return
+				}
+			}
+			illTyped[p.ID] = "type information incomplete"
+		}
+	})
+	return illTyped
+}
+
+// ComputeCallgraph checks ctx before computing only, the callgraph algorithms can not be interrupted.
+func (a *Analysis) ComputeCallgraph(ctx context.Context, data *ProgramAnalysis) (*callgraph.Graph, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	switch a.Algo {
 	case CallGraphTypeStatic:
 		return static.CallGraph(data.Prog), nil
@@ -110,6 +197,34 @@ func (a *Analysis) ComputeCallgraph(data *ProgramAnalysis) (*callgraph.Graph, er
 	}
 }
 
+// deleteSyntheticNodes is like callgraph.Graph.DeleteSyntheticNodes, but keeps the
+// instantiations of generic functions, which are synthetic as well.
+func deleteSyntheticNodes(g *callgraph.Graph) {
+	edges := make(map[callgraph.Edge]bool)
+	for _, cgn := range g.Nodes {
+		for _, e := range cgn.Out {
+			edges[*e] = true
+		}
+	}
+	for fn, cgn := range g.Nodes {
+		if cgn == g.Root || fn.Synthetic == "" || fn.Origin() != nil ||
+			(fn.Pkg != nil && fn.Pkg.Func("init") == fn) {
+			continue
+		}
+		for _, eIn := range cgn.In {
+			for _, eOut := range cgn.Out {
+				newEdge := callgraph.Edge{Caller: eIn.Caller, Site: eIn.Site, Callee: eOut.Callee}
+				if edges[newEdge] {
+					continue
+				}
+				callgraph.AddEdge(eIn.Caller, eIn.Site, eOut.Callee)
+				edges[newEdge] = true
+			}
+		}
+		g.DeleteNode(cgn)
+	}
+}
+
 func mainPackages(pkgs []*ssa.Package) ([]*ssa.Package, error) {
 	var mains []*ssa.Package
 	for _, p := range pkgs {
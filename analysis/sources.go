@@ -0,0 +1,261 @@
+package analysis
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/laindream/go-callflow-vis/cache"
+	"github.com/laindream/go-callflow-vis/log"
+	"github.com/laindream/go-callflow-vis/util"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const stageSources = "sources"
+
+// sourceFile is a hashed source file with the size and modification time it was hashed at.
+type sourceFile struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+	Hash    string `json:"hash"`
+}
+
+// sourceHasher hashes the contents of the go sources. The hashes of the files are kept in the
+// cache by path, and a file is only read again if its size or modification time changed.
+type sourceHasher struct {
+	cache cache.Cache
+	key   string
+	// known are the files of the cache, files the ones hashed by this run
+	known   map[string]*sourceFile
+	files   map[string]*sourceFile
+	dirs    map[string]string
+	changed bool
+}
+
+func newSourceHasher(c cache.Cache, dirs []string) *sourceHasher {
+	h := &sourceHasher{
+		cache: c,
+		key:   fmt.Sprintf("%s_%s", stageSources, util.GetHash(dirs)),
+		known: make(map[string]*sourceFile),
+		files: make(map[string]*sourceFile),
+		dirs:  make(map[string]string),
+	}
+	err := c.GetStream(h.key, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&h.known)
+	})
+	if err != nil {
+		h.known = make(map[string]*sourceFile)
+	}
+	return h
+}
+
+// hashDir hashes the go sources under the dir, skipping hidden dirs, dirs starting with "_",
+// testdata and nested modules like the go command does.
+func (h *sourceHasher) hashDir(root string) string {
+	if hash, ok := h.dirs[root]; ok {
+		return hash
+	}
+	paths := make([]string, 0)
+	infos := make(map[string]fs.FileInfo)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.GetLogger().Warnf("Analysis.hashSources: %v", err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if path == root {
+				return nil
+			}
+			if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(name, ".go") && name != "go.mod" && name != "go.sum" &&
+			name != "go.work" && name != "go.work.sum" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		paths = append(paths, path)
+		infos[path] = info
+		return nil
+	})
+	if err != nil {
+		log.GetLogger().Warnf("Analysis.hashSources: walk %s error: %v", root, err)
+	}
+	sort.Strings(paths)
+	hash := md5.New()
+	for _, path := range paths {
+		rel, _ := filepath.Rel(root, path)
+		fmt.Fprintf(hash, "%s %s\n", filepath.ToSlash(rel), h.hashFile(path, infos[path]))
+	}
+	h.dirs[root] = hex.EncodeToString(hash.Sum(nil))
+	return h.dirs[root]
+}
+
+// hashFile returns the hash of the contents of the file, the known one if its size and
+// modification time did not change, empty if it does not exist.
+func (h *sourceHasher) hashFile(path string, info fs.FileInfo) string {
+	if f, ok := h.files[path]; ok {
+		return f.Hash
+	}
+	if info == nil {
+		var err error
+		if info, err = os.Stat(path); err != nil {
+			return ""
+		}
+	}
+	f := &sourceFile{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	if known, ok := h.known[path]; ok && known.Size == f.Size && known.ModTime == f.ModTime {
+		f.Hash = known.Hash
+	} else {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.GetLogger().Warnf("Analysis.hashSources: %v", err)
+			return ""
+		}
+		sum := md5.Sum(data)
+		f.Hash = hex.EncodeToString(sum[:])
+		h.changed = true
+	}
+	h.files[path] = f
+	return f.Hash
+}
+
+// save stores the hashes of the files hashed by this run if any was read or removed.
+func (h *sourceHasher) save() {
+	if !h.changed && len(h.files) == len(h.known) {
+		return
+	}
+	err := h.cache.SetStream(h.key, &cache.Meta{Stage: stageSources}, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(h.files)
+	})
+	if err != nil {
+		log.GetLogger().Errorf("Analysis.hashSources cache set error: %v", err)
+	}
+}
+
+// getSourceHashes returns the hashes of the sources the callgraph depends on, once per analysis:
+// the ones of every local module by its path, i.e. the modules of the query dirs, the uses of the
+// workspace and the targets of local replaces, and the go.work file by its path. The query dirs
+// are hashed by their paths instead if the modules cannot be read.
+func (a *Analysis) getSourceHashes() map[string]string {
+	if a.sourcesHash != nil {
+		return a.sourcesHash
+	}
+	// the keys of the dirs
+	keys := make(map[string]string)
+	modules, err := a.getLocalModules()
+	if err != nil {
+		log.GetLogger().Warnf("Analysis.getSourceHashes: %v", err)
+		queryDirs := a.GetQueryDirs()
+		if len(queryDirs) == 0 {
+			queryDirs = []string{"."}
+		}
+		for _, dir := range queryDirs {
+			if abs, err := filepath.Abs(dir); err == nil {
+				keys[abs] = abs
+			}
+		}
+	}
+	for _, m := range modules {
+		keys[m.Root] = m.Path
+	}
+	dirs := make([]string, 0, len(keys))
+	for dir, _ := range keys {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	h := a.getSourceHasher(dirs)
+	hashes := make(map[string]string)
+	for _, dir := range dirs {
+		key := keys[dir]
+		if _, ok := hashes[key]; ok {
+			// another copy of the module
+			key = dir
+		}
+		hashes[key] = h.hashDir(dir)
+	}
+	if workFile := a.getWorkFile(); workFile != "" {
+		hashes[workFile] = h.hashFile(workFile, nil)
+	}
+	h.save()
+	a.sourcesHash = hashes
+	return hashes
+}
+
+func (a *Analysis) getSourceHasher(dirs []string) *sourceHasher {
+	if a.sources == nil {
+		a.sources = newSourceHasher(a.cache, dirs)
+	}
+	return a.sources
+}
+
+// getWorkFile returns the go.work file the modules are loaded by: the workspace, or the one the go
+// command finds for a single query dir. Several query dirs are loaded by a temporary one.
+func (a *Analysis) getWorkFile() string {
+	if a.Workspace != "" {
+		if abs, err := filepath.Abs(a.Workspace); err == nil {
+			return abs
+		}
+		return a.Workspace
+	}
+	dirs := a.GetQueryDirs()
+	if len(dirs) > 1 {
+		return ""
+	}
+	dir := "."
+	if len(dirs) == 1 {
+		dir = dirs[0]
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	return findWorkFile(abs)
+}
+
+// getLocalModules returns the local modules of the query dirs and of the workspace, see
+// getLocalModules, once per analysis.
+func (a *Analysis) getLocalModules() ([]*localModule, error) {
+	if a.modules != nil {
+		return a.modules, nil
+	}
+	dirs := a.GetQueryDirs()
+	if len(dirs) == 0 && a.Workspace == "" {
+		dirs = []string{"."}
+	}
+	modRoots := make([]string, 0)
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		modRoot, err := findModuleRoot(abs)
+		if err != nil {
+			return nil, err
+		}
+		modRoots = append(modRoots, modRoot)
+	}
+	modules, err := getLocalModules(modRoots, a.getWorkFile())
+	if err != nil {
+		return nil, err
+	}
+	a.modules = modules
+	return modules, nil
+}
@@ -0,0 +1,97 @@
+package analysis
+
+import (
+	"fmt"
+	"github.com/laindream/go-callflow-vis/cache"
+	"github.com/laindream/go-callflow-vis/config"
+	"github.com/laindream/go-callflow-vis/mode"
+	"github.com/laindream/go-callflow-vis/util"
+)
+
+// The analysis caches the result of each stage under a key made of the inputs of the stage, so a
+// change of an input only recomputes the stages from the first one depending on it:
+//
+//	raw:      callgraph_<hash(program analysis params, sources by module)>
+//	filtered: <raw>_filter_<hash(focus, ignore)>
+//	min:      <filtered>_min_<hash(layers, allow skip, pairs)>
+//	flow:     <min>_flow_<hash(fast mode, max rounds)>
+//
+// The sources are the contents of the go files, go.mod, go.sum and go.work files of every local
+// module, i.e. the modules of the query dirs, the uses of the workspace and the targets of local
+// replaces, and of the go.work file, see getSourceHashes. All modules are analyzed as one program,
+// the key is made of the hash of each module, so the meta of an entry tells the module it depends
+// on. They are hashed once per run, and a file is only read when its size or modification time
+// changed since the last run. The parallelism and the low
+// memory mode do not change the results, neither does the package prefix, which only shortens the
+// rendered names.
+type stageKeys struct {
+	Raw      string
+	Filtered string
+	Min      string
+	Flow     string
+}
+
+const (
+	stageRaw      = "raw"
+	stageFiltered = "filtered"
+	stageMin      = "min"
+	stageFlow     = "flow"
+)
+
+func (a *Analysis) getStageKeys() *stageKeys {
+	if a.keys != nil {
+		return a.keys
+	}
+	raw := fmt.Sprintf("%s_%s", "callgraph", util.GetHash(a.getStageInputs(stageRaw)))
+	filtered := fmt.Sprintf("%s_filter_%s", raw, util.GetHash(a.getStageInputs(stageFiltered)))
+	min := fmt.Sprintf("%s_min_%s", filtered, util.GetHash(a.getStageInputs(stageMin)))
+	flow := fmt.Sprintf("%s_flow_%s", min, util.GetHash(a.getStageInputs(stageFlow)))
+	a.keys = &stageKeys{Raw: raw, Filtered: filtered, Min: min, Flow: flow}
+	return a.keys
+}
+
+// getStageInputs returns the inputs the key of the stage is made of, besides the key of the
+// previous stage.
+func (a *Analysis) getStageInputs(stage string) interface{} {
+	switch stage {
+	case stageRaw:
+		return &struct {
+			Param   *ProgramAnalysisParam `json:"param"`
+			Sources map[string]string     `json:"sources"`
+		}{
+			Param:   a.ProgramAnalysisParam,
+			Sources: a.getSourceHashes(),
+		}
+	case stageFiltered:
+		return &struct {
+			Focus  mode.Set `json:"focus"`
+			Ignore mode.Set `json:"ignore"`
+		}{
+			Focus:  a.config.Focus,
+			Ignore: a.config.Ignore,
+		}
+	case stageMin:
+		return &struct {
+			Layers    []*config.Layer `json:"layers"`
+			AllowSkip bool            `json:"allow_skip"`
+			Pairs     []*config.Pair  `json:"pairs"`
+		}{
+			Layers:    a.config.Layers,
+			AllowSkip: a.config.AllowSkip,
+			Pairs:     a.config.Pairs,
+		}
+	case stageFlow:
+		return &struct {
+			FastMode  bool `json:"fast_mode"`
+			MaxRounds int  `json:"max_rounds"`
+		}{
+			FastMode:  a.fastMode,
+			MaxRounds: a.maxRounds,
+		}
+	}
+	return nil
+}
+
+func (a *Analysis) getStageMeta(stage string) *cache.Meta {
+	return &cache.Meta{Stage: stage, Params: a.getStageInputs(stage)}
+}
@@ -0,0 +1,325 @@
+package analysis
+
+import (
+	"fmt"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultWorkGoVersion = "1.18"
+
+type workspace struct {
+	workFile string
+	// roots are the directories the package patterns are resolved against
+	roots   []string
+	cleanup func()
+}
+
+// prepareWorkspace makes the modules of all query dirs loadable in one go, either by the given
+// go.work file or by a temporary go.work using the module roots of the query dirs.
+func prepareWorkspace(workFile string, queryDirs []string) (*workspace, error) {
+	ws := &workspace{cleanup: func() {}}
+	for _, dir := range queryDirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		ws.roots = append(ws.roots, abs)
+	}
+	if workFile != "" {
+		abs, err := filepath.Abs(workFile)
+		if err != nil {
+			return nil, err
+		}
+		ws.workFile = abs
+		if len(ws.roots) == 0 {
+			uses, err := getWorkUses(abs)
+			if err != nil {
+				return nil, err
+			}
+			ws.roots = uses
+		}
+		return ws, nil
+	}
+	modRoots := make([]string, 0)
+	modRootSet := make(map[string]bool)
+	goVersion := defaultWorkGoVersion
+	for _, root := range ws.roots {
+		modRoot, err := findModuleRoot(root)
+		if err != nil {
+			return nil, err
+		}
+		if modRootSet[modRoot] {
+			continue
+		}
+		modRootSet[modRoot] = true
+		modRoots = append(modRoots, modRoot)
+		v, err := getModuleGoVersion(modRoot)
+		if err != nil {
+			return nil, err
+		}
+		if semver.Compare("v"+v, "v"+goVersion) > 0 {
+			goVersion = v
+		}
+	}
+	tmpDir, err := os.MkdirTemp("", "go_callflow_vis_work")
+	if err != nil {
+		return nil, err
+	}
+	work := &modfile.WorkFile{Syntax: new(modfile.FileSyntax)}
+	if err = work.AddGoStmt(goVersion); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	for _, modRoot := range modRoots {
+		if err = work.AddUse(modRoot, ""); err != nil {
+			os.RemoveAll(tmpDir)
+			return nil, err
+		}
+	}
+	ws.workFile = filepath.Join(tmpDir, "go.work")
+	if err = os.WriteFile(ws.workFile, modfile.Format(work.Syntax), 0644); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	ws.cleanup = func() {
+		os.RemoveAll(tmpDir)
+	}
+	return ws, nil
+}
+
+// patterns resolves the relative package patterns against every root, e.g. "./..." for
+// roots a and b becomes "/abs/a/..." and "/abs/b/...". Import path patterns are kept as is.
+func (ws *workspace) patterns(pkgPatterns []string) []string {
+	patterns := make([]string, 0)
+	for _, p := range pkgPatterns {
+		if p != "." && p != ".." && !strings.HasPrefix(p, "./") && !strings.HasPrefix(p, "../") {
+			patterns = append(patterns, p)
+			continue
+		}
+		for _, root := range ws.roots {
+			pattern := filepath.Join(root, p)
+			if strings.HasSuffix(p, "/...") {
+				pattern = filepath.Join(root, strings.TrimSuffix(p, "/...")) + "/..."
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func getWorkUses(workFile string) ([]string, error) {
+	data, err := os.ReadFile(workFile)
+	if err != nil {
+		return nil, err
+	}
+	work, err := modfile.ParseWork(workFile, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	uses := make([]string, 0)
+	for _, u := range work.Use {
+		dir := u.Path
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(workFile), dir)
+		}
+		uses = append(uses, dir)
+	}
+	if len(uses) == 0 {
+		return nil, fmt.Errorf("no use directive in %s", workFile)
+	}
+	return uses, nil
+}
+
+// localModule is a module on disk the analysis depends on: a module of the query dirs, a use of
+// the workspace or the target of a local replace.
+type localModule struct {
+	Root string
+	Path string
+	mod  *modfile.File
+}
+
+// getLocalModules returns the local modules of the module roots and of the workspace, the modules
+// of the roots first, and the ones they replace by local dirs, transitively. The replaces of the
+// workspace apply to all modules and take precedence over the ones of the modules.
+func getLocalModules(modRoots []string, workFile string) ([]*localModule, error) {
+	modules := make([]*localModule, 0)
+	byRoot := make(map[string]*localModule)
+	add := func(root string) (*localModule, error) {
+		if m, ok := byRoot[root]; ok {
+			return m, nil
+		}
+		filename := filepath.Join(root, "go.mod")
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		// ParseLax would skip the replaces
+		mod, err := modfile.Parse(filename, data, nil)
+		if err != nil {
+			return nil, err
+		}
+		if mod.Module == nil {
+			return nil, fmt.Errorf("no module path in %s", filename)
+		}
+		m := &localModule{Root: root, Path: mod.Module.Mod.Path, mod: mod}
+		byRoot[root] = m
+		modules = append(modules, m)
+		return m, nil
+	}
+	for _, root := range modRoots {
+		if _, err := add(root); err != nil {
+			return nil, err
+		}
+	}
+	// the workspace replaces apply to all modules
+	workReplaces := make(map[string]string)
+	if workFile != "" {
+		uses, err := getWorkUses(workFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, use := range uses {
+			if _, err = add(use); err != nil {
+				return nil, err
+			}
+		}
+		data, err := os.ReadFile(workFile)
+		if err != nil {
+			return nil, err
+		}
+		work, err := modfile.ParseWork(workFile, data, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range work.Replace {
+			if dir := getReplaceDir(r, filepath.Dir(workFile)); dir != "" {
+				workReplaces[r.Old.Path] = dir
+			}
+		}
+	}
+	for i := 0; i < len(modules); i++ {
+		m := modules[i]
+		replaces := make(map[string]string)
+		for k, v := range workReplaces {
+			replaces[k] = v
+		}
+		for _, r := range m.mod.Replace {
+			if _, ok := workReplaces[r.Old.Path]; ok {
+				continue
+			}
+			if dir := getReplaceDir(r, m.Root); dir != "" {
+				replaces[r.Old.Path] = dir
+			}
+		}
+		for _, req := range m.mod.Require {
+			if dir, ok := replaces[req.Mod.Path]; ok {
+				if _, err := add(dir); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return modules, nil
+}
+
+// getReplaceDir returns the dir a replace by a local path refers to, empty for a module replace.
+func getReplaceDir(r *modfile.Replace, base string) string {
+	if r.New.Version != "" || !modfile.IsDirectoryPath(r.New.Path) {
+		return ""
+	}
+	if filepath.IsAbs(r.New.Path) {
+		return filepath.Clean(r.New.Path)
+	}
+	return filepath.Join(base, r.New.Path)
+}
+
+// findWorkFile returns the go.work file the go command uses for dir: the one of GOWORK, or the
+// first one in dir and its parents, empty if none or GOWORK is off.
+func findWorkFile(dir string) string {
+	if gowork := os.Getenv("GOWORK"); gowork != "" {
+		if gowork == "off" {
+			return ""
+		}
+		return gowork
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "go.work")); err == nil {
+			return filepath.Join(d, "go.work")
+		}
+		if filepath.Dir(d) == d {
+			return ""
+		}
+	}
+}
+
+func findModuleRoot(dir string) (string, error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d, nil
+		}
+		if filepath.Dir(d) == d {
+			return "", fmt.Errorf("no go.mod found for %s", dir)
+		}
+	}
+}
+
+func getModuleGoVersion(modRoot string) (string, error) {
+	filename := filepath.Join(modRoot, "go.mod")
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	mod, err := modfile.ParseLax(filename, data, nil)
+	if err != nil {
+		return "", err
+	}
+	if mod.Go == nil {
+		return defaultWorkGoVersion, nil
+	}
+	return mod.Go.Version, nil
+}
+
+// GetModulePaths returns the paths of the modules analyzed, those of the query dirs, of the uses
+// of the workspace or of the current dir.
+func (a *Analysis) GetModulePaths() ([]string, error) {
+	dirs := a.GetQueryDirs()
+	if len(dirs) == 0 && a.Workspace != "" {
+		uses, err := getWorkUses(a.Workspace)
+		if err != nil {
+			return nil, err
+		}
+		dirs = uses
+	}
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	paths := make([]string, 0)
+	pathSet := make(map[string]bool)
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		modRoot, err := findModuleRoot(abs)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(modRoot, "go.mod"))
+		if err != nil {
+			return nil, err
+		}
+		path := modfile.ModulePath(data)
+		if path == "" {
+			return nil, fmt.Errorf("no module path in %s", filepath.Join(modRoot, "go.mod"))
+		}
+		if !pathSet[path] {
+			pathSet[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
@@ -1,15 +1,12 @@
 package cache
 
 import (
-	"bufio"
 	"fmt"
 	"github.com/apache/incubator-fury/go/fury"
 	"github.com/laindream/go-callflow-vis/ir"
 	"io"
-	"log"
-	"os"
-	"path/filepath"
-	"strings"
+	"runtime"
+	"time"
 )
 
 var (
@@ -17,6 +14,12 @@ var (
 	furyC            *fury.Fury
 )
 
+const (
+	BackendFile   = "file"
+	BackendShared = "shared"
+	BackendMemory = "memory"
+)
+
 func GetFury() *fury.Fury {
 	return furyC
 }
@@ -34,61 +37,91 @@ func init() {
 	furyC = fr
 }
 
-type FileCache struct {
-	path string
+// Cache stores values by key. Every entry starts with a header holding the format version and
+// the checksum of the value, entries of other versions or with a checksum mismatch are reported
+// as errors by Get and GetStream, so they are recomputed.
+type Cache interface {
+	// Set stores the value, callgraphs in the ir stream format and other values by fury. The
+	// meta, which may be nil, describes what produced the value.
+	Set(key string, value interface{}, meta *Meta) error
+	Get(key string, valuePtr interface{}) error
+	// SetStream stores the value written by write in its own format, e.g. a flow result.
+	SetStream(key string, meta *Meta, write func(w io.Writer) error) error
+	// GetStream passes the value stored by SetStream to read. The reader is an io.ByteReader, so
+	// decoders reading from it do not read ahead. The checksum is verified after read returns,
+	// so the value read must only be used when GetStream returns nil.
+	GetStream(key string, read func(r io.Reader) error) error
+	// List returns the metas of the entries sorted by key.
+	List() ([]*Meta, error)
+	Info(key string) (*Meta, error)
+	Remove(key string) error
+	// Prune removes the entries created before the time and returns the removed ones.
+	Prune(before time.Time) ([]*Meta, error)
+	// Clear removes all entries and returns their number.
+	Clear() (int, error)
 }
 
-func NewFileCache(path string) *FileCache {
-	if path == "" {
-		path = defaultCachePath
-	}
-	if strings.HasSuffix(path, "/") {
-		path = path[:len(path)-1]
+// NewCache returns the cache of the backend, path is the dir of the file backends.
+func NewCache(backend string, path string) (Cache, error) {
+	switch backend {
+	case "", BackendFile:
+		return NewFileCache(path), nil
+	case BackendShared:
+		if !lockSupported {
+			return nil, fmt.Errorf("cache backend %s needs file locks, which are not supported on %s", BackendShared, runtime.GOOS)
+		}
+		return NewSharedCache(path), nil
+	case BackendMemory:
+		return NewMemoryCache(), nil
 	}
-	return &FileCache{path: path}
+	return nil, fmt.Errorf("unknown cache backend %q, possible values include: %s, %s, %s",
+		backend, BackendFile, BackendShared, BackendMemory)
 }
 
-func (f *FileCache) Set(key string, value interface{}) error {
-	filename := fmt.Sprintf("%s/%s.fury", f.path, key)
-	dir := filepath.Dir(filename)
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		return err
-	}
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+func writeValue(w io.Writer, value interface{}) error {
+	if cg, ok := value.(*ir.Callgraph); ok {
+		return ir.WriteCallgraph(w, cg)
 	}
-	defer file.Close()
-	writer := bufio.NewWriter(file)
 	bytes, err := GetFury().Marshal(value)
 	if err != nil {
 		return err
 	}
-	_, err = writer.Write(bytes)
-	if err != nil {
-		return err
-	}
-	if err := writer.Flush(); err != nil {
-		return err
-	}
-	return nil
+	_, err = w.Write(bytes)
+	return err
 }
 
-func (f *FileCache) Get(key string, valuePtr interface{}) error {
-	file, err := os.Open(fmt.Sprintf("%s/%s.fury", f.path, key))
-	if err != nil {
-		return err
+// getValue reads the value by getStream into valuePtr, which is only set when the entry is valid.
+func getValue(getStream func(read func(r io.Reader) error) error, valuePtr interface{}) error {
+	if cgPtr, ok := valuePtr.(**ir.Callgraph); ok {
+		var cg *ir.Callgraph
+		err := getStream(func(r io.Reader) (err error) {
+			cg, err = ir.ReadCallgraph(r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		*cgPtr = cg
+		return nil
 	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
-	bytes, err := io.ReadAll(reader)
-	if err != nil {
-		log.Printf("Error reading from reader: %v", err)
+	var bytes []byte
+	err := getStream(func(r io.Reader) (err error) {
+		bytes, err = io.ReadAll(r)
 		return err
-	}
-	err = GetFury().Unmarshal(bytes, valuePtr)
+	})
 	if err != nil {
 		return err
 	}
-	return nil
+	return GetFury().Unmarshal(bytes, valuePtr)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
 }
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"github.com/laindream/go-callflow-vis/ir"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type testBackend struct {
+	name     string
+	newCache func(t *testing.T) Cache
+	// corrupt flips the last byte of the stream entry of the key
+	corrupt func(t *testing.T, c Cache, key string)
+}
+
+func getTestBackends() []testBackend {
+	corruptFile := func(t *testing.T, f *FileCache, key string) {
+		filename := f.getStreamFilename(key)
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[len(b)-1] ^= 1
+		if err = os.WriteFile(filename, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backends := []testBackend{
+		{
+			name: BackendFile,
+			newCache: func(t *testing.T) Cache {
+				return NewFileCache(t.TempDir())
+			},
+			corrupt: func(t *testing.T, c Cache, key string) {
+				corruptFile(t, c.(*FileCache), key)
+			},
+		},
+		{
+			name: BackendMemory,
+			newCache: func(t *testing.T) Cache {
+				return NewMemoryCache()
+			},
+			corrupt: func(t *testing.T, c Cache, key string) {
+				data := c.(*MemoryCache).entries[key].data
+				data[len(data)-1] ^= 1
+			},
+		},
+	}
+	if lockSupported {
+		backends = append(backends, testBackend{
+			name: BackendShared,
+			newCache: func(t *testing.T) Cache {
+				return NewSharedCache(t.TempDir())
+			},
+			corrupt: func(t *testing.T, c Cache, key string) {
+				corruptFile(t, c.(*SharedCache).FileCache, key)
+			},
+		})
+	}
+	return backends
+}
+
+func setStream(c Cache, key string, value []byte) error {
+	return c.SetStream(key, &Meta{Stage: "test"}, func(w io.Writer) error {
+		_, err := w.Write(value)
+		return err
+	})
+}
+
+func getStream(c Cache, key string) ([]byte, error) {
+	var value []byte
+	err := c.GetStream(key, func(r io.Reader) (err error) {
+		value, err = io.ReadAll(r)
+		return err
+	})
+	return value, err
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, b := range getTestBackends() {
+		t.Run(b.name, func(t *testing.T) {
+			c := b.newCache(t)
+			if _, err := getStream(c, "missing"); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("missing entry: got error %v, want %v", err, os.ErrNotExist)
+			}
+			for _, value := range [][]byte{[]byte("first value"), []byte("replaced"), {}} {
+				if err := setStream(c, "key", value); err != nil {
+					t.Fatal(err)
+				}
+				got, err := getStream(c, "key")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, value) {
+					t.Fatalf("got %q, want %q", got, value)
+				}
+			}
+			meta, err := c.Info("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Key != "key" || meta.Stage != "test" || meta.Version != FormatVersion {
+				t.Fatalf("unexpected meta %+v", meta)
+			}
+			if err = c.Remove("key"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = getStream(c, "key"); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("removed entry: got error %v, want %v", err, os.ErrNotExist)
+			}
+		})
+	}
+}
+
+func TestStreamChecksumMismatch(t *testing.T) {
+	for _, b := range getTestBackends() {
+		t.Run(b.name, func(t *testing.T) {
+			c := b.newCache(t)
+			if err := setStream(c, "key", []byte("some value")); err != nil {
+				t.Fatal(err)
+			}
+			b.corrupt(t, c, "key")
+			if _, err := getStream(c, "key"); !errors.Is(err, ErrChecksum) {
+				t.Fatalf("got error %v, want %v", err, ErrChecksum)
+			}
+		})
+	}
+}
+
+func TestValueRoundTrip(t *testing.T) {
+	for _, b := range getTestBackends() {
+		t.Run(b.name, func(t *testing.T) {
+			c := b.newCache(t)
+			cg := &ir.Callgraph{Nodes: make(map[string]*ir.Node)}
+			cg.AddNode(&ir.Func{Name: "pkg.A", Addr: "0x1"})
+			cg.AddNode(&ir.Func{Name: "pkg.B", Addr: "0x2"})
+			cg.AddEdge("0x1", "0x2", &ir.Site{Name: "pkg.B()", Addr: "s1"})
+			if err := c.Set("callgraph", cg, nil); err != nil {
+				t.Fatal(err)
+			}
+			var gotCg *ir.Callgraph
+			if err := c.Get("callgraph", &gotCg); err != nil {
+				t.Fatal(err)
+			}
+			if gotCg == nil || len(gotCg.Nodes) != 2 || len(gotCg.Nodes["0x1"].Out) != 1 ||
+				gotCg.Nodes["0x1"].Out[0].Callee.Func.Name != "pkg.B" {
+				t.Fatalf("unexpected callgraph %+v", gotCg)
+			}
+			names := []string{"pkg.A", "pkg.B"}
+			if err := c.Set("names", names, nil); err != nil {
+				t.Fatal(err)
+			}
+			var gotNames []string
+			if err := c.Get("names", &gotNames); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotNames, names) {
+				t.Fatalf("got %v, want %v", gotNames, names)
+			}
+		})
+	}
+}
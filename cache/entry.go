@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// An entry is a header followed by the encoded value:
+//
+//	magic    [4]byte "CFVC"
+//	version  uint16  FormatVersion
+//	length   uint64  length of the value
+//	checksum uint32  CRC-32C of the value
+//
+// all big endian.
+
+// FormatVersion is the version of the entry format and of the encodings of the values, i.e. the
+// ir stream format, the flow result and the fury types. It must be increased when any of them
+// changes, so entries of older tool versions are recomputed instead of misread.
+const FormatVersion uint16 = 2
+
+const (
+	entryMagic      = "CFVC"
+	entryHeaderSize = 4 + 2 + 8 + 4
+)
+
+var (
+	ErrFormat   = errors.New("not a cache entry")
+	ErrChecksum = errors.New("cache entry checksum mismatch")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// VersionError is returned for entries of another format version.
+type VersionError struct {
+	Version uint16
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("cache entry format version %d, expected %d", e.Version, FormatVersion)
+}
+
+type entryHeader struct {
+	Version  uint16
+	Length   uint64
+	Checksum uint32
+}
+
+func (h *entryHeader) marshal() []byte {
+	b := make([]byte, entryHeaderSize)
+	copy(b, entryMagic)
+	binary.BigEndian.PutUint16(b[4:], h.Version)
+	binary.BigEndian.PutUint64(b[6:], h.Length)
+	binary.BigEndian.PutUint32(b[14:], h.Checksum)
+	return b
+}
+
+// readEntryHeader reads the header, which may be of another version.
+func readEntryHeader(r io.Reader) (*entryHeader, error) {
+	b := make([]byte, entryHeaderSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrFormat
+		}
+		return nil, err
+	}
+	if string(b[:4]) != entryMagic {
+		return nil, ErrFormat
+	}
+	return &entryHeader{
+		Version:  binary.BigEndian.Uint16(b[4:]),
+		Length:   binary.BigEndian.Uint64(b[6:]),
+		Checksum: binary.BigEndian.Uint32(b[14:]),
+	}, nil
+}
+
+// writeEntryValue writes the value by write to w and returns the header of the entry, which is
+// written before the value by the caller.
+func writeEntryValue(w io.Writer, write func(w io.Writer) error) (*entryHeader, error) {
+	crc := crc32.New(crcTable)
+	writer := &countingWriter{w: io.MultiWriter(w, crc)}
+	if err := write(writer); err != nil {
+		return nil, err
+	}
+	return &entryHeader{Version: FormatVersion, Length: uint64(writer.n), Checksum: crc.Sum32()}, nil
+}
+
+// readEntry checks the header of the entry in r and passes its value to read, verifying the
+// checksum after read returns. A checksum mismatch is reported instead of the error of read.
+func readEntry(r io.Reader, read func(r io.Reader) error) error {
+	header, err := readEntryHeader(r)
+	if err != nil {
+		return err
+	}
+	if header.Version != FormatVersion {
+		return &VersionError{Version: header.Version}
+	}
+	crc := crc32.New(crcTable)
+	limited := &io.LimitedReader{R: r, N: int64(header.Length)}
+	reader := bufio.NewReader(io.TeeReader(limited, crc))
+	readErr := read(reader)
+	// the rest of the value, if any, takes part in the checksum, which also explains read errors
+	if _, err = io.Copy(io.Discard, reader); err != nil {
+		return err
+	}
+	if limited.N != 0 || crc.Sum32() != header.Checksum {
+		return ErrChecksum
+	}
+	return readErr
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newEntry(t *testing.T, value []byte) []byte {
+	buf := &bytes.Buffer{}
+	header, err := writeEntryValue(buf, func(w io.Writer) error {
+		_, err := w.Write(value)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(header.marshal(), buf.Bytes()...)
+}
+
+func TestEntryHeader(t *testing.T) {
+	header := &entryHeader{Version: 2, Length: 0x0102030405060708, Checksum: 0xaabbccdd}
+	want := []byte{'C', 'F', 'V', 'C', 0, 2, 1, 2, 3, 4, 5, 6, 7, 8, 0xaa, 0xbb, 0xcc, 0xdd}
+	b := header.marshal()
+	if !bytes.Equal(b, want) {
+		t.Fatalf("marshal: got %v, want %v", b, want)
+	}
+	read, err := readEntryHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *read != *header {
+		t.Fatalf("read: got %+v, want %+v", read, header)
+	}
+}
+
+func TestReadEntry(t *testing.T) {
+	value := []byte("the value of the entry")
+	errRead := errors.New("read error")
+	readAll := func(r io.Reader) ([]byte, error) {
+		return io.ReadAll(r)
+	}
+	readByte := func(r io.Reader) ([]byte, error) {
+		b := make([]byte, 1)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	failRead := func(r io.Reader) ([]byte, error) {
+		return nil, errRead
+	}
+	tests := []struct {
+		name string
+		// change changes a valid entry of value
+		change  func(b []byte) []byte
+		read    func(r io.Reader) ([]byte, error)
+		want    []byte
+		wantErr error
+		// wantVersion is the version of the VersionError expected
+		wantVersion uint16
+	}{
+		{name: "valid", read: readAll, want: value},
+		{name: "partial read", read: readByte, want: value[:1]},
+		{name: "trailing data", change: func(b []byte) []byte {
+			return append(b, "trailing"...)
+		}, read: readAll, want: value},
+		{name: "empty", change: func(b []byte) []byte {
+			return nil
+		}, read: readAll, wantErr: ErrFormat},
+		{name: "short header", change: func(b []byte) []byte {
+			return b[:entryHeaderSize-1]
+		}, read: readAll, wantErr: ErrFormat},
+		{name: "bad magic", change: func(b []byte) []byte {
+			copy(b, "CFVX")
+			return b
+		}, read: readAll, wantErr: ErrFormat},
+		{name: "older version", change: func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[4:], FormatVersion-1)
+			return b
+		}, read: readAll, wantVersion: FormatVersion - 1},
+		{name: "newer version", change: func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[4:], FormatVersion+1)
+			return b
+		}, read: readAll, wantVersion: FormatVersion + 1},
+		{name: "changed value", change: func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		}, read: readAll, wantErr: ErrChecksum},
+		{name: "changed checksum", change: func(b []byte) []byte {
+			b[entryHeaderSize-1] ^= 1
+			return b
+		}, read: readAll, wantErr: ErrChecksum},
+		{name: "truncated value", change: func(b []byte) []byte {
+			return b[:len(b)-1]
+		}, read: readAll, wantErr: ErrChecksum},
+		{name: "read error", read: failRead, wantErr: errRead},
+		{name: "read error of a changed value", change: func(b []byte) []byte {
+			b[entryHeaderSize] ^= 1
+			return b
+		}, read: failRead, wantErr: ErrChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newEntry(t, value)
+			if tt.change != nil {
+				b = tt.change(b)
+			}
+			var got []byte
+			err := readEntry(bytes.NewReader(b), func(r io.Reader) (err error) {
+				got, err = tt.read(r)
+				return err
+			})
+			if tt.wantVersion != 0 {
+				var versionErr *VersionError
+				if !errors.As(err, &versionErr) || versionErr.Version != tt.wantVersion {
+					t.Fatalf("got error %v, want version %d", err, tt.wantVersion)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
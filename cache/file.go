@@ -0,0 +1,327 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/laindream/go-callflow-vis/ir"
+	"github.com/laindream/go-callflow-vis/log"
+	"github.com/laindream/go-callflow-vis/progress"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const metaExt = ".meta"
+
+// entryExts are the extensions of the cache files, see getFilename and SetStream.
+var entryExts = []string{".cg", ".fury", ".stream"}
+
+// FileCache stores the entries as files in a dir, with a JSON sidecar holding the meta of each.
+type FileCache struct {
+	path string
+}
+
+func NewFileCache(path string) *FileCache {
+	if path == "" {
+		path = defaultCachePath
+	}
+	if strings.HasSuffix(path, "/") {
+		path = path[:len(path)-1]
+	}
+	return &FileCache{path: path}
+}
+
+// getFilename returns the cache file of key. Callgraphs are streamed in the ir stream format,
+// other values are marshaled by fury.
+func (f *FileCache) getFilename(key string, value interface{}) string {
+	switch value.(type) {
+	case *ir.Callgraph, **ir.Callgraph:
+		return fmt.Sprintf("%s/%s.cg", f.path, key)
+	}
+	return fmt.Sprintf("%s/%s.fury", f.path, key)
+}
+
+func (f *FileCache) getStreamFilename(key string) string {
+	return fmt.Sprintf("%s/%s.stream", f.path, key)
+}
+
+func (f *FileCache) getMetaFilename(key string) string {
+	return fmt.Sprintf("%s/%s%s", f.path, key, metaExt)
+}
+
+// Set writes the value to a temporary file renamed to the cache file at last, so an interrupted
+// write never leaves a partial cache file.
+func (f *FileCache) Set(key string, value interface{}, meta *Meta) error {
+	return f.writeFile(key, f.getFilename(key, value), meta, func(w io.Writer) error {
+		return writeValue(w, value)
+	})
+}
+
+func (f *FileCache) Get(key string, valuePtr interface{}) error {
+	filename := f.getFilename(key, valuePtr)
+	return getValue(func(read func(r io.Reader) error) error {
+		return f.readFile(key, filename, read)
+	}, valuePtr)
+}
+
+func (f *FileCache) SetStream(key string, meta *Meta, write func(w io.Writer) error) error {
+	return f.writeFile(key, f.getStreamFilename(key), meta, write)
+}
+
+func (f *FileCache) GetStream(key string, read func(r io.Reader) error) error {
+	return f.readFile(key, f.getStreamFilename(key), read)
+}
+
+func (f *FileCache) writeFile(key string, filename string, meta *Meta, write func(w io.Writer) error) error {
+	writePhase := progress.GetTracker().Start(progress.PhaseCacheWrite)
+	var header *entryHeader
+	err := writeFileAtomic(filename, func(file *os.File) error {
+		// the header is written last, when the length and checksum of the value are known
+		if _, err := file.Write(make([]byte, entryHeaderSize)); err != nil {
+			return err
+		}
+		writer := bufio.NewWriter(file)
+		var err error
+		header, err = writeEntryValue(writer, write)
+		if err != nil {
+			return err
+		}
+		if err = writer.Flush(); err != nil {
+			return err
+		}
+		_, err = file.WriteAt(header.marshal(), 0)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	m := newMeta(key, header, meta)
+	m.File = filepath.Base(filename)
+	writePhase.Done(int(m.Size))
+	bytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.getMetaFilename(key), func(file *os.File) error {
+		_, err := file.Write(bytes)
+		return err
+	})
+}
+
+func (f *FileCache) readFile(key string, filename string, read func(r io.Reader) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	readPhase := progress.GetTracker().Start(progress.PhaseCacheRead)
+	err = readEntry(bufio.NewReader(file), read)
+	var versionErr *VersionError
+	if errors.As(err, &versionErr) {
+		log.GetLogger().Debugf("FileCache: entry %s is recomputed: %v", key, err)
+		return err
+	}
+	if errors.Is(err, ErrFormat) || errors.Is(err, ErrChecksum) {
+		log.GetLogger().Warnf("cache entry %s is unusable and recomputed: %v", key, err)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	stat, _ := file.Stat()
+	if stat != nil {
+		readPhase.Done(int(stat.Size()))
+	}
+	return nil
+}
+
+// writeFileAtomic writes a temporary file renamed to filename at last, so an interrupted write
+// never leaves a partial file.
+func writeFileAtomic(filename string, write func(file *os.File) error) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err = write(file); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+func (f *FileCache) List() ([]*Meta, error) {
+	return f.list(f.Info)
+}
+
+func (f *FileCache) list(info func(key string) (*Meta, error)) ([]*Meta, error) {
+	keys, err := f.getKeys()
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]*Meta, 0, len(keys))
+	for _, key := range keys {
+		meta, err := info(key)
+		if errors.Is(err, os.ErrNotExist) {
+			// removed since listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Key < metas[j].Key
+	})
+	return metas, nil
+}
+
+func (f *FileCache) Info(key string) (*Meta, error) {
+	filename := f.getEntryFilename(key)
+	if filename == "" {
+		return nil, fmt.Errorf("no cache entry %s in %s: %w", key, f.path, os.ErrNotExist)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	meta := &Meta{}
+	bytes, err := os.ReadFile(f.getMetaFilename(key))
+	if err == nil {
+		err = json.Unmarshal(bytes, meta)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading meta of %s: %w", key, err)
+	}
+	if err != nil {
+		meta.Created = stat.ModTime()
+	}
+	header, err := readEntryHeader(file)
+	if err != nil && !errors.Is(err, ErrFormat) {
+		return nil, err
+	}
+	meta.setHeader(header)
+	meta.Key = key
+	meta.File = filepath.Base(filename)
+	meta.Size = stat.Size()
+	return meta, nil
+}
+
+func (f *FileCache) Remove(key string) error {
+	filename := f.getEntryFilename(key)
+	if filename == "" {
+		return fmt.Errorf("no cache entry %s in %s: %w", key, f.path, os.ErrNotExist)
+	}
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+	if err := os.Remove(f.getMetaFilename(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileCache) Prune(before time.Time) ([]*Meta, error) {
+	return pruneEntries(f.List, f.Remove, before)
+}
+
+// Clear removes all entries, their sidecars and leftover temporary files. Other files in the
+// cache dir are kept.
+func (f *FileCache) Clear() (int, error) {
+	return f.clear(f.Remove, true)
+}
+
+// clear removes the entries by remove, and with all also orphan sidecars and temporary files.
+func (f *FileCache) clear(remove func(key string) error, all bool) (int, error) {
+	keys, err := f.getKeys()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		err = remove(key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if !all {
+		return count, nil
+	}
+	dirEntries, err := os.ReadDir(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return count, nil
+	}
+	if err != nil {
+		return count, err
+	}
+	for _, d := range dirEntries {
+		name := d.Name()
+		if d.IsDir() || !(strings.HasSuffix(name, metaExt) || strings.Contains(name, ".tmp")) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(f.path, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (f *FileCache) getKeys() ([]string, error) {
+	dirEntries, err := os.ReadDir(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, d := range dirEntries {
+		key, ok := getEntryKey(d.Name())
+		if d.IsDir() || !ok {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (f *FileCache) getEntryFilename(key string) string {
+	for _, ext := range entryExts {
+		filename := fmt.Sprintf("%s/%s%s", f.path, key, ext)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+	}
+	return ""
+}
+
+func getEntryKey(name string) (string, bool) {
+	for _, ext := range entryExts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package cache
+
+import (
+	"errors"
+	"os"
+)
+
+// lockSupported tells if lockFile locks, the shared backend needs it
+const lockSupported = false
+
+var errLockUnsupported = errors.New("file locks are not supported on this platform")
+
+func lockFile(file *os.File, exclusive bool) error {
+	return errLockUnsupported
+}
+
+func unlockFile(file *os.File) error {
+	return errLockUnsupported
+}
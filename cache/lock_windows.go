@@ -0,0 +1,26 @@
+//go:build windows
+
+package cache
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// lockSupported tells if lockFile locks, the shared backend needs it
+const lockSupported = true
+
+// the whole file is locked, LockFileEx locks a byte range
+const lockRange = ^uint32(0)
+
+func lockFile(file *os.File, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	return windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, lockRange, lockRange, new(windows.Overlapped))
+}
+
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, lockRange, lockRange, new(windows.Overlapped))
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryCache keeps the entries in memory for the run only, e.g. for tests or to run without
+// writing files. The entries are encoded like the file ones, so both go through the same checks.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	data []byte
+	meta *Meta
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]*memoryEntry)}
+}
+
+func (m *MemoryCache) Set(key string, value interface{}, meta *Meta) error {
+	return m.SetStream(key, meta, func(w io.Writer) error {
+		return writeValue(w, value)
+	})
+}
+
+func (m *MemoryCache) Get(key string, valuePtr interface{}) error {
+	return getValue(func(read func(r io.Reader) error) error {
+		return m.GetStream(key, read)
+	}, valuePtr)
+}
+
+func (m *MemoryCache) SetStream(key string, meta *Meta, write func(w io.Writer) error) error {
+	value := &bytes.Buffer{}
+	header, err := writeEntryValue(value, write)
+	if err != nil {
+		return err
+	}
+	data := append(header.marshal(), value.Bytes()...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = &memoryEntry{data: data, meta: newMeta(key, header, meta)}
+	return nil
+}
+
+func (m *MemoryCache) GetStream(key string, read func(r io.Reader) error) error {
+	m.mu.Lock()
+	e, ok := m.entries[key]
+	m.mu.Unlock()
+	if !ok {
+		return m.notFound(key)
+	}
+	return readEntry(bytes.NewReader(e.data), read)
+}
+
+func (m *MemoryCache) List() ([]*Meta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metas := make([]*Meta, 0, len(m.entries))
+	for _, e := range m.entries {
+		meta := *e.meta
+		metas = append(metas, &meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Key < metas[j].Key
+	})
+	return metas, nil
+}
+
+func (m *MemoryCache) Info(key string) (*Meta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, m.notFound(key)
+	}
+	meta := *e.meta
+	return &meta, nil
+}
+
+func (m *MemoryCache) Remove(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[key]; !ok {
+		return m.notFound(key)
+	}
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *MemoryCache) Prune(before time.Time) ([]*Meta, error) {
+	return pruneEntries(m.List, m.Remove, before)
+}
+
+func (m *MemoryCache) Clear() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := len(m.entries)
+	m.entries = make(map[string]*memoryEntry)
+	return count, nil
+}
+
+func (m *MemoryCache) notFound(key string) error {
+	return fmt.Errorf("no cache entry %s in memory: %w", key, os.ErrNotExist)
+}
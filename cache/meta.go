@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// Meta describes a cache entry and what produced it. The file backends write it as a JSON
+// sidecar next to the entry, entries written before sidecars existed get a Meta from their file
+// only.
+type Meta struct {
+	Key     string    `json:"key"`
+	File    string    `json:"file,omitempty"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	// Version is the format version of the entry, 0 for entries without header
+	Version uint16 `json:"version"`
+	// Checksum is the CRC-32C of the value in hex
+	Checksum string `json:"checksum,omitempty"`
+	// Stage is the analysis stage of the entry, e.g. filtered
+	Stage string `json:"stage,omitempty"`
+	// Params are the inputs of the stage the key was made of
+	Params interface{} `json:"params,omitempty"`
+}
+
+func newMeta(key string, header *entryHeader, meta *Meta) *Meta {
+	m := &Meta{}
+	if meta != nil {
+		*m = *meta
+	}
+	m.Key = key
+	m.Size = int64(entryHeaderSize) + int64(header.Length)
+	m.Created = time.Now()
+	m.setHeader(header)
+	return m
+}
+
+func (m *Meta) setHeader(header *entryHeader) {
+	if header == nil {
+		m.Version = 0
+		m.Checksum = ""
+		return
+	}
+	m.Version = header.Version
+	m.Checksum = fmt.Sprintf("%08x", header.Checksum)
+}
+
+// pruneEntries removes the listed entries created before the time.
+func pruneEntries(list func() ([]*Meta, error), remove func(key string) error, before time.Time) ([]*Meta, error) {
+	metas, err := list()
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]*Meta, 0)
+	for _, m := range metas {
+		if !m.Created.Before(before) {
+			continue
+		}
+		if err = remove(m.Key); err != nil {
+			return removed, err
+		}
+		removed = append(removed, m)
+	}
+	return removed, nil
+}
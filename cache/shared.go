@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const locksDir = ".locks"
+
+// SharedCache is a file cache whose dir is shared by concurrent processes, e.g. the CI jobs of
+// one runner. An entry and its sidecar are written under an exclusive lock of the key and read
+// under a shared one, so readers never see an entry replaced or removed halfway. The lock files
+// are kept in a subdir and never removed, as removing a lock file would split the lock.
+type SharedCache struct {
+	*FileCache
+}
+
+func NewSharedCache(path string) *SharedCache {
+	return &SharedCache{FileCache: NewFileCache(path)}
+}
+
+func (s *SharedCache) lock(key string, exclusive bool) (func(), error) {
+	dir := fmt.Sprintf("%s/%s", s.path, locksDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(fmt.Sprintf("%s/%s.lock", dir, key), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(file, exclusive); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("locking cache entry %s: %w", key, err)
+	}
+	return func() {
+		_ = unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+func (s *SharedCache) Set(key string, value interface{}, meta *Meta) error {
+	unlock, err := s.lock(key, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.FileCache.Set(key, value, meta)
+}
+
+func (s *SharedCache) Get(key string, valuePtr interface{}) error {
+	unlock, err := s.lock(key, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.FileCache.Get(key, valuePtr)
+}
+
+func (s *SharedCache) SetStream(key string, meta *Meta, write func(w io.Writer) error) error {
+	unlock, err := s.lock(key, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.FileCache.SetStream(key, meta, write)
+}
+
+func (s *SharedCache) GetStream(key string, read func(r io.Reader) error) error {
+	unlock, err := s.lock(key, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.FileCache.GetStream(key, read)
+}
+
+func (s *SharedCache) List() ([]*Meta, error) {
+	return s.list(s.Info)
+}
+
+func (s *SharedCache) Info(key string) (*Meta, error) {
+	unlock, err := s.lock(key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.FileCache.Info(key)
+}
+
+func (s *SharedCache) Remove(key string) error {
+	unlock, err := s.lock(key, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.FileCache.Remove(key)
+}
+
+func (s *SharedCache) Prune(before time.Time) ([]*Meta, error) {
+	return pruneEntries(s.List, s.Remove, before)
+}
+
+// Clear removes all entries and their sidecars. Temporary files are kept, they may belong to
+// writes in progress.
+func (s *SharedCache) Clear() (int, error) {
+	return s.clear(s.Remove, false)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/laindream/go-callflow-vis/cache"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const CacheUsage = `Usage: go-callflow-vis cache [-cache-dir <cache_dir>] [-cache-backend <backend>] COMMAND
+Examples:
+    go-callflow-vis cache ls
+    go-callflow-vis cache prune -older-than 7d
+Options:
+    -cache-dir <cache_dir> (Optional, Default: ./.go_callflow_vis_cache): Directory of the cache files.
+    -cache-backend <backend> (Optional, Default: file): Backend of the cache dir. Use shared for a dir shared by concurrent runs, so entries in use are locked.
+Commands:
+    ls: List the cache entries with their size, age, format version, stage and the params of the stage they were made of.
+    info <key>: Print the metadata of a cache entry.
+    prune -older-than <age>: Remove the cache entries older than the age (e.g. 36h or 7d).
+    clear: Remove all cache entries.
+
+`
+
+const paramsWidth = 60
+
+func runCacheCommand(args []string) int {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	dir := fs.String("cache-dir", "", "Directory of the cache files")
+	backend := fs.String("cache-backend", cache.BackendFile, "Backend of the cache dir")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, CacheUsage)
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *backend == cache.BackendMemory {
+		_, _ = fmt.Fprintf(os.Stderr, "the memory cache backend keeps no entries to manage\n")
+		return 2
+	}
+	c, err := cache.NewCache(*backend, *dir)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	command, args := fs.Arg(0), fs.Args()[1:]
+	switch command {
+	case "ls":
+		return cacheLs(c)
+	case "info":
+		if len(args) != 1 {
+			_, _ = fmt.Fprintf(os.Stderr, "cache info: expected one key\n")
+			return 2
+		}
+		return cacheInfo(c, args[0])
+	case "prune":
+		pruneFs := flag.NewFlagSet("cache prune", flag.ExitOnError)
+		olderThan := pruneFs.String("older-than", "", "(Required)Remove the cache entries older than the age, e.g. 36h or 7d")
+		_ = pruneFs.Parse(args)
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "cache prune: invalid -older-than %q: %v\n", *olderThan, err)
+			return 2
+		}
+		return cachePrune(c, age)
+	case "clear":
+		return cacheClear(c)
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "unknown cache command %q\n", command)
+	fs.Usage()
+	return 2
+}
+
+func cacheLs(c cache.Cache) int {
+	metas, err := c.List()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to list cache: %v\n", err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "KEY\tSIZE\tAGE\tVERSION\tSTAGE\tPARAMS")
+	var total int64
+	for _, m := range metas {
+		params := ""
+		if m.Params != nil {
+			bytes, _ := json.Marshal(m.Params)
+			params = string(bytes)
+			if len(params) > paramsWidth {
+				params = params[:paramsWidth-3] + "..."
+			}
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", m.Key, formatSize(m.Size), formatAge(time.Since(m.Created)), m.Version, m.Stage, params)
+		total += m.Size
+	}
+	_ = w.Flush()
+	fmt.Printf("%d entries, %s\n", len(metas), formatSize(total))
+	return 0
+}
+
+func cacheInfo(c cache.Cache, key string) int {
+	m, err := c.Info(key)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to get cache entry: %v\n", err)
+		return 1
+	}
+	bytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to print cache entry: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(bytes))
+	return 0
+}
+
+func cachePrune(c cache.Cache, age time.Duration) int {
+	removed, err := c.Prune(time.Now().Add(-age))
+	for _, m := range removed {
+		fmt.Printf("removed %s (%s, %s old)\n", m.Key, formatSize(m.Size), formatAge(time.Since(m.Created)))
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to prune cache: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d entries removed\n", len(removed))
+	return 0
+}
+
+func cacheClear(c cache.Cache) int {
+	count, err := c.Clear()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to clear cache: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d entries removed\n", count)
+	return 0
+}
+
+// parseAge parses a duration which may also be given in days, e.g. 7d.
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("age is required")
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", int(d/(24*time.Hour)), int(d%(24*time.Hour)/time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	}
+	return fmt.Sprintf("%ds", int(d/time.Second))
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/laindream/go-callflow-vis/analysis"
+	"github.com/laindream/go-callflow-vis/cache"
+	"github.com/laindream/go-callflow-vis/config"
+	"github.com/laindream/go-callflow-vis/log"
+	"github.com/laindream/go-callflow-vis/mode"
+	"github.com/laindream/go-callflow-vis/scaffold"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+const InitUsage = `Usage: go-callflow-vis init [OPTIONS] PACKAGE...
+Propose a layered config for the packages: the packages of the module are clustered by naming
+convention (api, handler, service, repo, dao) or else by their top level directory, and the
+clusters are ordered by the direction of the calls between them.
+With -infer the layers are inferred from the calls instead: the packages of the filtered callgraph
+are ranked by the longest call path to them, with the cycles between them broken, and every call
+against the inferred layers is reported as a violation.
+Examples: (When you are in the root directory of the project)
+    go-callflow-vis init ./...
+    go-callflow-vis init -infer -config ./focus.toml -out ./callflow.toml ./...
+    go-callflow-vis -config ./callflow.toml ./...
+Options:
+    -out <config_file> (Optional, Default: callflow.toml): Path of the config file to write, - for stdout.
+    -force (Optional): Overwrite the config file if it exists.
+    -infer (Optional): Infer the layers from the calls between the packages instead of their names.
+    -config <config_file> (Optional, Default: ""): Config whose package_prefix, focus, ignore and builds are used and kept, its layers are ignored. Default: the packages of the module.
+    -violations <csv_file> (Optional, Default: violations.csv): Path of the report of the calls against the inferred layers, written with -infer if there are any.
+    -algo <algo> (Optional, Default: cha): The algorithm used to construct the call graph, see go-callflow-vis -h.
+    -query-dir <query_dir> (Optional, Default: ""): Directory to query from for Go packages, separated with commas for multiple module roots.
+    -workspace <go_work_file> (Optional, Default: ""): Path to a go.work file whose modules are analyzed as one program.
+    -tests (Optional): Consider test files as entry points for the call graph.
+    -allow-errors (Optional): Analyze the well-typed packages only instead of failing when packages contain errors.
+    -build <build_flags> (Optional, Default: ""): Build flags to pass to the Go build tool. Flags should be separated with spaces.
+    -cache-dir <cache_dir> (Optional, Default: ./.go_callflow_vis_cache): Directory to store cache files. The callgraph is cached for the runs with the config.
+    -cache-backend <backend> (Optional, Default: file): Where to store the cache, see go-callflow-vis -h.
+    -debug (Optional): Print debug information.
+
+`
+
+func runInitCommand(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	out := fs.String("out", "callflow.toml", "Path of the config file to write, - for stdout")
+	force := fs.Bool("force", false, "Overwrite the config file if it exists")
+	infer := fs.Bool("infer", false, "Infer the layers from the calls between the packages")
+	configPath := fs.String("config", "", "Config whose package_prefix, focus, ignore and builds are used")
+	violations := fs.String("violations", "violations.csv", "Path of the report of the calls against the inferred layers")
+	algo := fs.String("algo", analysis.CallGraphTypeCha, "The algorithm used to construct the call graph")
+	queryDir := fs.String("query-dir", "", "Directory to query from for go packages")
+	workspace := fs.String("workspace", "", "Path to a go.work file")
+	tests := fs.Bool("tests", false, "Consider tests files as entry points for call-graph")
+	allowErrors := fs.Bool("allow-errors", false, "Analyze the well-typed packages only when packages contain errors")
+	build := fs.String("build", "", "Build flags to pass to Go build tool. Separated with spaces")
+	dir := fs.String("cache-dir", "", "Directory to store cache files")
+	backend := fs.String("cache-backend", cache.BackendFile, "Where to store the cache")
+	debug := fs.Bool("debug", false, "Print debug information")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, InitUsage)
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *debug {
+		log.SetLogger(*debug)
+	}
+	if *out != "-" && !*force {
+		if _, err := os.Stat(*out); err == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s exists, use -force to overwrite it\n", *out)
+			return 1
+		}
+	}
+	var buildFlags []string
+	if len(*build) > 0 {
+		buildFlags = strings.Split(*build, " ")
+	}
+	var queryDirs []string
+	if len(*queryDir) > 0 {
+		queryDirs = strings.Split(*queryDir, ",")
+	}
+	c, err := cache.NewCache(*backend, *dir)
+	if err != nil {
+		log.GetLogger().Errorf("failed to create cache: %v", err)
+		return 2
+	}
+	conf := &config.Config{}
+	if *configPath != "" {
+		// the layers are not needed, so the config is not loaded by LoadConfig, which validates them
+		conf, err = config.LoadBaseConfig(*configPath)
+		if err != nil {
+			log.GetLogger().Errorf("failed to load config: %v", err)
+			return 1
+		}
+	}
+	a := analysis.NewAnalysis(conf, c, analysis.CallgraphType(*algo), *tests, queryDirs, *workspace,
+		fs.Args(), buildFlags, nil, *allowErrors, false, false, 0, 1, false)
+	modules, err := a.GetModulePaths()
+	if err != nil {
+		log.GetLogger().Errorf("failed to get modules: %v", err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if *configPath == "" {
+		conf.Focus = getModuleFocus(modules)
+		if err = conf.Focus.Compile(); err != nil {
+			log.GetLogger().Errorf("failed to compile focus: %v", err)
+			return 1
+		}
+	}
+	err = a.InitCallgraph(ctx)
+	if err == nil {
+		err = a.FilterCallGraph(ctx)
+	}
+	stop()
+	if errors.Is(err, context.Canceled) {
+		log.GetLogger().Errorf("init cancelled")
+		return 130
+	}
+	if err != nil {
+		log.GetLogger().Errorf("failed to build callgraph: %v", err)
+		return 1
+	}
+	var p *scaffold.Proposal
+	if *infer {
+		p = scaffold.Infer(a.GetCallgraph(), modules)
+	} else {
+		p = scaffold.Propose(a.GetCallgraph(), modules)
+	}
+	if *configPath != "" {
+		p.Base = conf
+	}
+	if len(p.Violations) > 0 {
+		if err = p.WriteViolations(*violations, ""); err != nil {
+			log.GetLogger().Errorf("failed to write violations: %v", err)
+			return 1
+		}
+		log.GetLogger().Warnf("%d calls against the inferred layers written to %s", p.GetViolationCalls(), *violations)
+	}
+	source := "go-callflow-vis init " + strings.Join(args, " ")
+	if *out == "-" {
+		if err = p.WriteTOML(os.Stdout, source); err != nil {
+			log.GetLogger().Errorf("failed to write config: %v", err)
+			return 1
+		}
+		return 0
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		log.GetLogger().Errorf("failed to create config: %v", err)
+		return 1
+	}
+	err = p.WriteTOML(file, source)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.GetLogger().Errorf("failed to write config: %v", err)
+		return 1
+	}
+	log.GetLogger().Infof("config with %d layers written to %s", len(p.Layers), *out)
+	return 0
+}
+
+// getModuleFocus returns the focus on the packages of the modules.
+func getModuleFocus(modules []string) mode.Set {
+	rules := make([]mode.Rule, 0)
+	for _, m := range modules {
+		rules = append(rules, mode.Rule{Type: mode.MatchTypePackage, Content: m},
+			mode.Rule{Type: mode.MatchTypePackage, Content: m + "/*"})
+	}
+	return mode.Set{{OR: true, Rules: rules}}
+}
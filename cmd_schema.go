@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/laindream/go-callflow-vis/config"
+	"os"
+)
+
+//go:generate sh -c "go run . schema > config.schema.json"
+
+const SchemaUsage = `Usage: go-callflow-vis schema
+Print the JSON Schema of the config files, which is also published as config.schema.json.
+
+`
+
+func runSchemaCommand(args []string) int {
+	if len(args) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, SchemaUsage)
+		return 2
+	}
+	bytes, err := json.MarshalIndent(config.GetSchema(), "", "  ")
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to print schema: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(bytes))
+	return 0
+}
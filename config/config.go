@@ -2,41 +2,121 @@ package config
 
 import (
 	"fmt"
-	"github.com/BurntSushi/toml"
 	"github.com/laindream/go-callflow-vis/log"
 	"github.com/laindream/go-callflow-vis/mode"
+	"strings"
 )
 
 type Config struct {
-	PackagePrefix string   `toml:"package_prefix" json:"-"`
-	Focus         mode.Set `toml:"focus" json:"focus"`
-	Ignore        mode.Set `toml:"ignore" json:"ignore"`
-	Layers        []*Layer `toml:"layer" json:"-"`
+	PackagePrefix string   `toml:"package_prefix" yaml:"package_prefix" json:"-"`
+	Focus         mode.Set `toml:"focus" yaml:"focus" json:"focus"`
+	Ignore        mode.Set `toml:"ignore" yaml:"ignore" json:"ignore"`
+	Layers        []*Layer `toml:"layer" yaml:"layer" json:"-"`
+	Builds        []*Build `toml:"build" yaml:"build" json:"-"`
+	// AllowSkip lets the flows skip any layer they do not start or end at, like optional layers
+	AllowSkip bool `toml:"allow_skip" yaml:"allow_skip" json:"-"`
+	// Pairs constrain the paths between layers
+	Pairs []*Pair `toml:"pair" yaml:"pair" json:"-"`
+	// Include, Vars and Templates are resolved by LoadConfig, see Resolve
+	Include   []string           `toml:"include" yaml:"include" json:"-"`
+	Vars      map[string]string  `toml:"vars" yaml:"vars" json:"-"`
+	Templates map[string]*Entity `toml:"template" yaml:"template" json:"-"`
+}
+
+// Build is one build configuration of the matrix, the callgraphs of all builds are merged.
+type Build struct {
+	Name   string   `toml:"name" yaml:"name" json:"name"`
+	GOOS   string   `toml:"goos" yaml:"goos" json:"goos"`
+	GOARCH string   `toml:"goarch" yaml:"goarch" json:"goarch"`
+	Tags   []string `toml:"tags" yaml:"tags" json:"tags"`
+	Env    []string `toml:"env" yaml:"env" json:"env"`
+}
+
+func (b *Build) GetEnv() []string {
+	env := make([]string, 0)
+	if b.GOOS != "" {
+		env = append(env, "GOOS="+b.GOOS)
+	}
+	if b.GOARCH != "" {
+		env = append(env, "GOARCH="+b.GOARCH)
+	}
+	return append(env, b.Env...)
+}
+
+func (b *Build) GetBuildFlags() []string {
+	if len(b.Tags) == 0 {
+		return nil
+	}
+	return []string{"-tags=" + strings.Join(b.Tags, ",")}
+}
+
+func (b *Build) getDefaultName() string {
+	name := strings.Trim(fmt.Sprintf("%s/%s", b.GOOS, b.GOARCH), "/")
+	if len(b.Tags) > 0 {
+		name = strings.Trim(fmt.Sprintf("%s+%s", name, strings.Join(b.Tags, "+")), "+")
+	}
+	if name == "" {
+		name = "default"
+	}
+	return name
 }
 
 type Layer struct {
-	Name     string    `toml:"name"`
-	Entities []*Entity `toml:"entities"`
+	Name     string    `toml:"name" yaml:"name"`
+	Entities []*Entity `toml:"entities" yaml:"entities"`
+	// Optional lets the flows skip the layer, i.e. go from the previous layer to the next one
+	// directly
+	Optional bool `toml:"optional" yaml:"optional"`
+	// Next names the layers the layer flows to, see Config.GetSuccessors
+	Next []string `toml:"next" yaml:"next"`
 }
 
 type Entity struct {
-	Name      *mode.Mode `toml:"name" json:"name,omitempty"`
-	InSite    *mode.Mode `toml:"in_site" json:"in_site,omitempty"`
-	OutSite   *mode.Mode `toml:"out_site" json:"out_site,omitempty"`
-	Signature *mode.Mode `toml:"signature" json:"signature,omitempty"`
+	// Template is the name of the template the entity is based on, its modes override the ones of
+	// the template
+	Template  string     `toml:"template" yaml:"template" json:"template,omitempty"`
+	Name      *mode.Mode `toml:"name" yaml:"name" json:"name,omitempty"`
+	Origin    *mode.Mode `toml:"origin" yaml:"origin" json:"origin,omitempty"`
+	InSite    *mode.Mode `toml:"in_site" yaml:"in_site" json:"in_site,omitempty"`
+	OutSite   *mode.Mode `toml:"out_site" yaml:"out_site" json:"out_site,omitempty"`
+	Signature *mode.Mode `toml:"signature" yaml:"signature" json:"signature,omitempty"`
 }
 
+// LoadConfig loads the config with its includes, and resolves its variables and templates before
+// validating it.
 func LoadConfig(path string) (*Config, error) {
-	var config Config
 	log.GetLogger().Debugf("loading config from %s", path)
-	if _, err := toml.DecodeFile(path, &config); err != nil {
+	config, err := loadConfigFile(path, nil)
+	if err != nil {
 		return nil, err
 	}
+	if err := config.Resolve(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
+	if err := config.Compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
 	log.GetLogger().Debugf("config loaded")
-	return &config, nil
+	return config, nil
+}
+
+// LoadBaseConfig loads the config like LoadConfig without validating its layers, for the settings
+// they share, e.g. focus and builds.
+func LoadBaseConfig(path string) (*Config, error) {
+	config, err := loadConfigFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Resolve(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := config.Compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
 }
 
 func (c *Config) Validate() error {
@@ -51,5 +131,86 @@ func (c *Config) Validate() error {
 			return fmt.Errorf("layer %d has no entities", i)
 		}
 	}
+	if err := c.validateLayerGraph(); err != nil {
+		return err
+	}
+	if err := c.validatePairs(); err != nil {
+		return err
+	}
+	buildNames := make(map[string]bool)
+	for i, b := range c.Builds {
+		if b.Name == "" {
+			b.Name = b.getDefaultName()
+		}
+		if buildNames[b.Name] {
+			return fmt.Errorf("build %d has duplicate name %q", i, b.Name)
+		}
+		buildNames[b.Name] = true
+		for _, env := range b.Env {
+			if !strings.Contains(env, "=") {
+				return fmt.Errorf("build %q has invalid env %q, expected KEY=VALUE", b.Name, env)
+			}
+		}
+	}
 	return nil
 }
+
+// Compile validates the match rules and compiles their regexps, errors are reported with the key
+// path of the rule, e.g. layer[2].entities[0].name.rules[1].
+func (c *Config) Compile() error {
+	if err := c.Focus.Compile(); err != nil {
+		return mode.WithPath("focus", err)
+	}
+	if err := c.Ignore.Compile(); err != nil {
+		return mode.WithPath("ignore", err)
+	}
+	for i, layer := range c.Layers {
+		for j, e := range layer.Entities {
+			if err := e.Compile(); err != nil {
+				return mode.WithPath(fmt.Sprintf("layer[%d].entities[%d]", i, j), err)
+			}
+		}
+	}
+	for i, p := range c.Pairs {
+		for j, m := range p.Via {
+			if err := m.Compile(); err != nil {
+				return mode.WithPath(fmt.Sprintf("pair[%d].via[%d]", i, j), err)
+			}
+		}
+		if p.Avoid == nil {
+			continue
+		}
+		if err := p.Avoid.Compile(); err != nil {
+			return mode.WithPath(fmt.Sprintf("pair[%d].avoid", i), err)
+		}
+	}
+	return nil
+}
+
+func (e *Entity) Compile() error {
+	for _, m := range e.getModes() {
+		if m.mode == nil {
+			continue
+		}
+		if err := m.mode.Compile(); err != nil {
+			return mode.WithPath(m.key, err)
+		}
+	}
+	return nil
+}
+
+type entityMode struct {
+	key  string
+	mode *mode.Mode
+}
+
+// getModes returns the modes of the entity by their keys, unset ones included.
+func (e *Entity) getModes() []*entityMode {
+	return []*entityMode{
+		{"name", e.Name},
+		{"origin", e.Origin},
+		{"in_site", e.InSite},
+		{"out_site", e.OutSite},
+		{"signature", e.Signature},
+	}
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"encoding/json"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// decodeConfigFile decodes the config file by its extension, YAML for .yaml and .yml, JSON for
+// .json and TOML otherwise. All formats use the same keys, the ones of the toml and yaml tags.
+func decodeConfigFile(path string, config *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return yaml.Unmarshal(bytes, config)
+	case ".json":
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return decodeJSON(bytes, config)
+	}
+	_, err := toml.DecodeFile(path, config)
+	return err
+}
+
+// decodeJSON decodes JSON by encoding/json, yaml.v3 rejects some valid JSON like the \/ escape,
+// into the config by its yaml keys, as the json tags are the keys of the cache.
+func decodeJSON(bytes []byte, config *Config) error {
+	var value interface{}
+	if err := json.Unmarshal(bytes, &value); err != nil {
+		return err
+	}
+	var node yaml.Node
+	if err := node.Encode(value); err != nil {
+		return err
+	}
+	return node.Decode(config)
+}
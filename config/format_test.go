@@ -0,0 +1,77 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigFormats(t *testing.T) {
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"config.toml", `
+package_prefix = "example.com/demo/"
+[[layer]]
+name = "api"
+[[layer.entities]]
+name = { rules = [{ type = "prefix", content = "example.com/demo/api." }] }
+[[layer]]
+name = "svc"
+optional = true
+[[layer.entities]]
+name = { rules = [{ type = "prefix", content = "example.com/demo/svc." }] }
+[[layer]]
+name = "dao"
+[[layer.entities]]
+name = { rules = [{ type = "prefix", content = "example.com/demo/dao." }] }
+`},
+		{"config.yaml", `
+package_prefix: example.com/demo/
+layer:
+  - name: api
+    entities:
+      - name: { rules: [{ type: prefix, content: example.com/demo/api. }] }
+  - name: svc
+    optional: true
+    entities:
+      - name: { rules: [{ type: prefix, content: example.com/demo/svc. }] }
+  - name: dao
+    entities:
+      - name: { rules: [{ type: prefix, content: example.com/demo/dao. }] }
+`},
+		// \/ is a valid JSON escape yaml.v3 rejects
+		{"config.json", `{
+  "package_prefix": "example.com\/demo\/",
+  "layer": [
+    {"name": "api", "entities": [{"name": {"rules": [{"type": "prefix", "content": "example.com\/demo\/api."}]}}]},
+    {"name": "svc", "optional": true, "entities": [{"name": {"rules": [{"type": "prefix", "content": "example.com\/demo\/svc."}]}}]},
+    {"name": "dao", "entities": [{"name": {"rules": [{"type": "prefix", "content": "example.com\/demo\/dao."}]}}]}
+  ]
+}`},
+	}
+	dir := t.TempDir()
+	var want *Config
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		if config.PackagePrefix != "example.com/demo/" || len(config.Layers) != 3 || !config.Layers[1].Optional {
+			t.Fatalf("%s: unexpected config %+v", f.name, config)
+		}
+		if want == nil {
+			want = config
+			continue
+		}
+		if !reflect.DeepEqual(config.Layers, want.Layers) {
+			t.Errorf("%s: layers differ from %s", f.name, files[0].name)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"github.com/laindream/go-callflow-vis/mode"
+	"sort"
+)
+
+// Pair constrains the paths between two layers by their funcs: the paths pass the waypoints of
+// via in order, and avoid the funcs matched by avoid.
+type Pair struct {
+	From  string       `toml:"from" yaml:"from" json:"from"`
+	To    string       `toml:"to" yaml:"to" json:"to"`
+	Via   []*mode.Mode `toml:"via" yaml:"via" json:"via,omitempty"`
+	Avoid *mode.Mode   `toml:"avoid" yaml:"avoid" json:"avoid,omitempty"`
+}
+
+// GetPairLayers returns the indexes of the layers of the pair.
+func (c *Config) GetPairLayers(p *Pair) (from, to int, err error) {
+	from, to = -1, -1
+	for i, l := range c.Layers {
+		if l.Name == p.From {
+			from = i
+		}
+		if l.Name == p.To {
+			to = i
+		}
+	}
+	if from < 0 {
+		return 0, 0, fmt.Errorf("layer %q not found", p.From)
+	}
+	if to < 0 {
+		return 0, 0, fmt.Errorf("layer %q not found", p.To)
+	}
+	return from, to, nil
+}
+
+// GetSuccessors returns the indexes of the layers each layer flows to. Layers declaring next
+// flow to the layers of those names, and make the layers a DAG in which the layers without next
+// end the flows. Without any next the layers are a chain in the order of the config.
+func (c *Config) GetSuccessors() ([][]int, error) {
+	successors := make([][]int, len(c.Layers))
+	if !c.hasNext() {
+		for i := 0; i < len(c.Layers)-1; i++ {
+			successors[i] = []int{i + 1}
+		}
+		return successors, nil
+	}
+	byName := make(map[string]int)
+	for i, l := range c.Layers {
+		if l.Name == "" {
+			return nil, fmt.Errorf("layer %d has no name, which layers need for next", i)
+		}
+		if j, ok := byName[l.Name]; ok {
+			return nil, fmt.Errorf("layers %d and %d have the same name %q", j, i, l.Name)
+		}
+		byName[l.Name] = i
+	}
+	for i, l := range c.Layers {
+		for _, name := range l.Next {
+			j, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("layer %d: next layer %q not found", i, name)
+			}
+			if j == i {
+				return nil, fmt.Errorf("layer %d: next layer %q is the layer itself", i, name)
+			}
+			successors[i] = append(successors[i], j)
+		}
+	}
+	return successors, nil
+}
+
+func (c *Config) hasNext() bool {
+	for _, l := range c.Layers {
+		if len(l.Next) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLayerOrder returns the indexes of the layers in topological order of their successors, ties
+// in the order of the config, or an error if they have a cycle.
+func (c *Config) GetLayerOrder() ([]int, error) {
+	successors, err := c.GetSuccessors()
+	if err != nil {
+		return nil, err
+	}
+	inDegrees := make([]int, len(successors))
+	for _, s := range successors {
+		for _, j := range s {
+			inDegrees[j]++
+		}
+	}
+	ready := make([]int, 0)
+	for i, d := range inDegrees {
+		if d == 0 {
+			ready = append(ready, i)
+		}
+	}
+	order := make([]int, 0, len(successors))
+	for len(ready) > 0 {
+		sort.Ints(ready)
+		i := ready[0]
+		ready = ready[1:]
+		order = append(order, i)
+		for _, j := range successors[i] {
+			inDegrees[j]--
+			if inDegrees[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+	}
+	if len(order) < len(successors) {
+		for i, d := range inDegrees {
+			if d > 0 {
+				return nil, fmt.Errorf("layer %d is in a cycle of next layers", i)
+			}
+		}
+	}
+	return order, nil
+}
+
+// validateLayerGraph checks the layers form a DAG in which every layer takes part in a flow, and
+// optional layers are inside the flows.
+func (c *Config) validateLayerGraph() error {
+	successors, err := c.GetSuccessors()
+	if err != nil {
+		return err
+	}
+	if _, err = c.GetLayerOrder(); err != nil {
+		return err
+	}
+	hasPredecessors := make([]bool, len(c.Layers))
+	for _, s := range successors {
+		for _, j := range s {
+			hasPredecessors[j] = true
+		}
+	}
+	for i, l := range c.Layers {
+		if !hasPredecessors[i] && len(successors[i]) == 0 {
+			return fmt.Errorf("layer %d is not connected to other layers by next", i)
+		}
+		if l.Optional && (!hasPredecessors[i] || len(successors[i]) == 0) {
+			return fmt.Errorf("layer %d is optional, but flows start or end at it", i)
+		}
+	}
+	return nil
+}
+
+// validatePairs checks the pairs refer to distinct layers, once each, and constrain their paths.
+func (c *Config) validatePairs() error {
+	pairs := make(map[[2]int]int)
+	for i, p := range c.Pairs {
+		from, to, err := c.GetPairLayers(p)
+		if err != nil {
+			return fmt.Errorf("pair %d: %w", i, err)
+		}
+		if from == to {
+			return fmt.Errorf("pair %d: from and to are the same layer %q", i, p.From)
+		}
+		if len(p.Via) == 0 && p.Avoid == nil {
+			return fmt.Errorf("pair %d: neither via nor avoid is set", i)
+		}
+		if j, ok := pairs[[2]int{from, to}]; ok {
+			return fmt.Errorf("pairs %d and %d are both from %q to %q", j, i, p.From, p.To)
+		}
+		pairs[[2]int{from, to}] = i
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package config
+
+import (
+	"fmt"
+	"github.com/laindream/go-callflow-vis/mode"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// varPattern matches a variable reference, e.g. ${module}.
+var varPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// loadConfigFile decodes the config at path and merges it over its includes, which are relative
+// to the dir of path. stack holds the including files to report include cycles.
+func loadConfigFile(path string, stack []string) (*Config, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	stack = append(stack[:len(stack):len(stack)], abs)
+	for _, p := range stack[:len(stack)-1] {
+		if p == abs {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(stack, " -> "))
+		}
+	}
+	var config Config
+	if err := decodeConfigFile(path, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(config.Include) == 0 {
+		return &config, nil
+	}
+	base := &Config{}
+	for _, include := range config.Include {
+		includePath := include
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), include)
+		}
+		included, err := loadConfigFile(includePath, stack)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include %q: %w", path, include, err)
+		}
+		base.merge(included)
+	}
+	base.merge(&config)
+	base.Include = nil
+	return base, nil
+}
+
+// merge merges over into c. The package prefix of over replaces the one of c if set, allow_skip
+// is set if set in either, focus and ignore are appended, vars, templates, layers and builds
+// replace the ones of the same name and pairs the ones of the same layers, others are appended.
+func (c *Config) merge(over *Config) {
+	if over.PackagePrefix != "" {
+		c.PackagePrefix = over.PackagePrefix
+	}
+	c.AllowSkip = c.AllowSkip || over.AllowSkip
+	c.Focus = append(c.Focus, over.Focus...)
+	c.Ignore = append(c.Ignore, over.Ignore...)
+	if len(over.Vars) > 0 && c.Vars == nil {
+		c.Vars = make(map[string]string)
+	}
+	for k, v := range over.Vars {
+		c.Vars[k] = v
+	}
+	if len(over.Templates) > 0 && c.Templates == nil {
+		c.Templates = make(map[string]*Entity)
+	}
+	for k, v := range over.Templates {
+		c.Templates[k] = v
+	}
+	for _, l := range over.Layers {
+		replaced := false
+		for i, cl := range c.Layers {
+			if l.Name != "" && cl.Name == l.Name {
+				c.Layers[i] = l
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.Layers = append(c.Layers, l)
+		}
+	}
+	for _, p := range over.Pairs {
+		replaced := false
+		for i, cp := range c.Pairs {
+			if cp.From == p.From && cp.To == p.To {
+				c.Pairs[i] = p
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.Pairs = append(c.Pairs, p)
+		}
+	}
+	for _, b := range over.Builds {
+		replaced := false
+		for i, cb := range c.Builds {
+			if b.Name != "" && cb.Name == b.Name {
+				c.Builds[i] = b
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.Builds = append(c.Builds, b)
+		}
+	}
+}
+
+// Resolve substitutes the variables, e.g. ${module}, in the package prefix and the content of the
+// rules but the regexp ones, and bases the entities on their templates. Errors are reported with
+// the key path, e.g. layer[1].entities[0].template.
+func (c *Config) Resolve() error {
+	prefix, err := c.expandVars(c.PackagePrefix)
+	if err != nil {
+		return mode.WithPath("package_prefix", err)
+	}
+	c.PackagePrefix = prefix
+	for i, m := range c.Focus {
+		if err := m.Expand(c.expandVars); err != nil {
+			return mode.WithPath(fmt.Sprintf("focus[%d]", i), err)
+		}
+	}
+	for i, m := range c.Ignore {
+		if err := m.Expand(c.expandVars); err != nil {
+			return mode.WithPath(fmt.Sprintf("ignore[%d]", i), err)
+		}
+	}
+	names := make([]string, 0, len(c.Templates))
+	for name, _ := range c.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := fmt.Sprintf("template.%s", name)
+		t := c.Templates[name]
+		if t == nil {
+			return mode.WithPath(path, fmt.Errorf("template is empty"))
+		}
+		if t.Template != "" {
+			return mode.WithPath(path+".template", fmt.Errorf("a template can not be based on a template"))
+		}
+		if err := c.expandEntity(t); err != nil {
+			return mode.WithPath(path, err)
+		}
+	}
+	for i, layer := range c.Layers {
+		for j, e := range layer.Entities {
+			path := fmt.Sprintf("layer[%d].entities[%d]", i, j)
+			if err := c.expandEntity(e); err != nil {
+				return mode.WithPath(path, err)
+			}
+			if e.Template == "" {
+				continue
+			}
+			t, ok := c.Templates[e.Template]
+			if !ok {
+				return mode.WithPath(path+".template", fmt.Errorf("undefined template %q", e.Template))
+			}
+			e.applyTemplate(t)
+		}
+	}
+	for i, p := range c.Pairs {
+		for j, m := range p.Via {
+			if m == nil {
+				return mode.WithPath(fmt.Sprintf("pair[%d].via[%d]", i, j), fmt.Errorf("waypoint is empty"))
+			}
+			if err := m.Expand(c.expandVars); err != nil {
+				return mode.WithPath(fmt.Sprintf("pair[%d].via[%d]", i, j), err)
+			}
+		}
+		if p.Avoid == nil {
+			continue
+		}
+		if err := p.Avoid.Expand(c.expandVars); err != nil {
+			return mode.WithPath(fmt.Sprintf("pair[%d].avoid", i), err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) expandEntity(e *Entity) error {
+	for _, m := range e.getModes() {
+		if m.mode == nil {
+			continue
+		}
+		if err := m.mode.Expand(c.expandVars); err != nil {
+			return mode.WithPath(m.key, err)
+		}
+	}
+	return nil
+}
+
+// expandVars substitutes the variables in s, the values are not expanded again.
+func (c *Config) expandVars(s string) (string, error) {
+	var err error
+	expanded := varPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		value, ok := c.Vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("undefined variable %q", name)
+		}
+		if !ok {
+			return ref
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// applyTemplate sets the modes of the entity which are not set to the ones of the template.
+func (e *Entity) applyTemplate(t *Entity) {
+	if e.Name == nil {
+		e.Name = t.Name
+	}
+	if e.Origin == nil {
+		e.Origin = t.Origin
+	}
+	if e.InSite == nil {
+		e.InSite = t.InSite
+	}
+	if e.OutSite == nil {
+		e.OutSite = t.OutSite
+	}
+	if e.Signature == nil {
+		e.Signature = t.Signature
+	}
+}
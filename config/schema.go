@@ -0,0 +1,72 @@
+package config
+
+import (
+	"github.com/laindream/go-callflow-vis/mode"
+	"reflect"
+	"strings"
+)
+
+// GetSchema returns the JSON Schema of the config, generated from the toml keys of Config and the
+// types it is made of. The schema applies to all config formats, as they share the keys.
+func GetSchema() map[string]interface{} {
+	g := &schemaGenerator{definitions: make(map[string]interface{})}
+	schema := g.getObjectSchema(reflect.TypeOf(Config{}))
+	// lets JSON and YAML configs refer to the schema
+	schema["properties"].(map[string]interface{})["$schema"] = map[string]interface{}{"type": "string"}
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "go-callflow-vis config"
+	schema["definitions"] = g.definitions
+	return schema
+}
+
+type schemaGenerator struct {
+	definitions map[string]interface{}
+}
+
+func (g *schemaGenerator) getSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(mode.MatchType("")) {
+		types := make([]string, 0)
+		for _, matchType := range mode.GetMatchTypes() {
+			types = append(types, string(matchType))
+		}
+		return map[string]interface{}{"type": "string", "enum": types}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.getSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.getSchema(t.Elem())}
+	case reflect.Struct:
+		// the types are defined once by name, which also ends the recursion of nested rules
+		if _, ok := g.definitions[t.Name()]; !ok {
+			g.definitions[t.Name()] = nil
+			g.definitions[t.Name()] = g.getObjectSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func (g *schemaGenerator) getObjectSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if !field.IsExported() || key == "" || key == "-" {
+			continue
+		}
+		properties[key] = g.getSchema(field.Type)
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
@@ -1,19 +1,31 @@
 package flow
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/eapache/queue/v2"
 	"github.com/laindream/go-callflow-vis/cache"
 	"github.com/laindream/go-callflow-vis/ir"
 	"github.com/laindream/go-callflow-vis/log"
+	"github.com/laindream/go-callflow-vis/mode"
+	"github.com/laindream/go-callflow-vis/progress"
+	"sort"
+	"sync"
 )
 
+// ctxCheckInterval is the number of nodes a BFS visits between two checks of its context
+const ctxCheckInterval = 1024
+
 func (f *Flow) resetCallgraphIR() error {
+	if f.lowMemory {
+		f.callgraph.UndoChanges()
+		return nil
+	}
 	return cache.GetFury().Unmarshal(f.furyBuffer, &f.callgraph)
 }
 
-func (f *Flow) GetMinNodeSet() (map[*ir.Node]bool, error) {
+func (f *Flow) GetMinNodeSet(ctx context.Context) (map[*ir.Node]bool, error) {
 	minNodeSet := make(map[*ir.Node]bool)
 	if f == nil {
 		return nil, errors.New("flow is nil")
@@ -21,14 +33,12 @@ func (f *Flow) GetMinNodeSet() (map[*ir.Node]bool, error) {
 	if len(f.Layers) < 2 {
 		return nil, errors.New("number of layers must be at least 2")
 	}
-	for i, _ := range f.Layers {
-		if i == len(f.Layers)-1 {
-			continue
-		}
-		startNodes := f.Layers[i].GetOutAllNodeSet(f.callgraph)
-		endNodes := f.Layers[i+1].GetInAllNodeSet(f.callgraph)
-		nodeSet, _ := f.findReachableNodesIR(startNodes, endNodes, nil)
-		for k, _ := range nodeSet {
+	searches := f.getLayerPairSearches()
+	if err := f.searchLayerPairs(ctx, searches, false); err != nil {
+		return nil, err
+	}
+	for _, s := range searches {
+		for k, _ := range s.containSet {
 			minNodeSet[k] = true
 		}
 	}
@@ -36,146 +46,201 @@ func (f *Flow) GetMinNodeSet() (map[*ir.Node]bool, error) {
 	return minNodeSet, nil
 }
 
-func (f *Flow) findAllBipartite(isCallgraphJustReset bool) error {
+// findAllBipartite searches the reachability of all layer pairs round by round. A round
+// finding new issue funcs skips them and searches again, until no new issue func is found.
+// Unless in fast mode, the fixpoint is checked once more on the restored callgraph with all
+// issue funcs skipped. maxRounds limits the rounds, giving a partial result when reached.
+func (f *Flow) findAllBipartite(ctx context.Context) error {
 	if f == nil {
 		return errors.New("flow is nil")
 	}
 	if len(f.Layers) < 2 {
 		return errors.New("number of layers must be at least 2")
 	}
-	issueFuncs := make(map[string]bool)
-	for i, _ := range f.Layers {
-		if i == len(f.Layers)-1 {
-			continue
+	bipartitePhase := progress.GetTracker().Start(progress.PhaseBipartite)
+	isCallgraphJustReset := false
+	round := 1
+	for ; ; round++ {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		startNodes := f.Layers[i].GetOutAllNodeSet(f.callgraph)
-		endNodes := f.Layers[i+1].GetInAllNodeSet(f.callgraph)
-		var examplePath map[*ir.Node]map[*ir.Node][]*ir.Edge
-		_, examplePath = f.findReachableNodesIR(startNodes, endNodes, nil)
-		f.Layers[i].ExamplePath = examplePath
-		for _, v := range examplePath {
-			for _, v2 := range v {
-				isCheckPass, issueFunc := f.checkCallEdgeChain(v2)
-				if !isCheckPass && issueFunc != nil {
-					issueFuncs[issueFunc.Addr] = true
-				}
-			}
+		issueFuncs, err := f.findLayersBipartite(ctx)
+		if err != nil {
+			return err
 		}
-		starts, ends := GetStartAndEndFromExamplePath(examplePath)
-		for j, _ := range f.Layers[i].Entities {
-			f.Layers[i].Entities[j].TrimOutNodeSet(starts, f.callgraph)
-		}
-		for j, _ := range f.Layers[i+1].Entities {
-			f.Layers[i+1].Entities[j].TrimInNodeSet(ends, f.callgraph)
-		}
-		if i == 0 {
-			for j, _ := range f.Layers[i].Entities {
-				f.Layers[i].Entities[j].UpdateInSiteNodeSetWithNodeSet(f.callgraph)
-			}
-		}
-		if i == len(f.Layers)-2 {
-			for j, _ := range f.Layers[i+1].Entities {
-				f.Layers[i+1].Entities[j].UpdateOutSiteNodeSetWithNodeSet(f.callgraph)
-			}
-		}
-	}
-	if len(issueFuncs) > 0 {
-		addCount := 0
+		newIssueFuncs := make(map[string]bool)
 		for k, _ := range issueFuncs {
 			if f.allIssueFuncs == nil {
 				f.allIssueFuncs = make(map[string]bool)
 			}
 			if _, ok := f.allIssueFuncs[k]; !ok {
 				f.allIssueFuncs[k] = true
-				addCount++
+				newIssueFuncs[k] = true
 			}
 		}
-		log.GetLogger().Debugf("Find Incremental Issue Funcs:%d, Total Issue Funcs:%d, Regenerate Flow",
-			addCount, len(f.allIssueFuncs))
-		f.skipNodesIR(f.allIssueFuncs)
-		f.resetLayer()
-		return f.findAllBipartite(false)
-	}
-	if !isCallgraphJustReset && len(issueFuncs) == 0 {
-		if f.fastMode {
-			log.GetLogger().Debugf("No Incremental Issue Funcs, Skip No Issue Check In Fast Mode")
-		} else {
-			log.GetLogger().Debugf("No Incremental Issue Funcs, Try No Issue Check")
-			if err := f.resetCallgraphIR(); err != nil {
-				return err
+		log.GetLogger().Debugf("Bipartite Round %d: Nodes:%d, Incremental Issue Funcs:%d, Total Issue Funcs:%d",
+			round, len(f.callgraph.Nodes), len(newIssueFuncs), len(f.allIssueFuncs))
+		bipartitePhase.Update(round, "round %d: %d nodes, %d new issue funcs, %d total",
+			round, len(f.callgraph.Nodes), len(newIssueFuncs), len(f.allIssueFuncs))
+		if len(newIssueFuncs) == 0 && (isCallgraphJustReset || f.fastMode) {
+			if f.fastMode {
+				log.GetLogger().Debugf("No Incremental Issue Funcs, Skip No Issue Check In Fast Mode")
 			}
-			f.skipNodesIR(f.allIssueFuncs)
+			break
+		}
+		if f.maxRounds > 0 && round >= f.maxRounds {
+			log.GetLogger().Warnf("Bipartite rounds reach the max rounds %d, the flow may be partial", f.maxRounds)
+			break
+		}
+		if len(newIssueFuncs) > 0 {
+			log.GetLogger().Debugf("Find Incremental Issue Funcs:%d, Total Issue Funcs:%d, Regenerate Flow",
+				len(newIssueFuncs), len(f.allIssueFuncs))
+			// the issue funcs of former rounds have been skipped already
+			f.skipNodesIR(newIssueFuncs)
 			f.resetLayer()
-			return f.findAllBipartite(true)
+			isCallgraphJustReset = false
+			continue
+		}
+		log.GetLogger().Debugf("No Incremental Issue Funcs, Try No Issue Check")
+		if err := f.resetCallgraphIR(); err != nil {
+			return err
 		}
+		f.skipNodesIR(f.allIssueFuncs)
+		f.resetLayer()
+		isCallgraphJustReset = true
 	}
-	for i := len(f.Layers) - 2; i >= 0; i-- {
-		for j, _ := range f.Layers[i].Entities {
-			originalEntityIn := make(map[*ir.Node]bool)
-			for k, _ := range f.Layers[i].Entities[j].GetInAllNodeSetOnlyRead(f.callgraph) {
-				originalEntityIn[k] = true
-			}
-			originalEntityNode := make(map[*ir.Node]bool)
-			for k, _ := range f.Layers[i].Entities[j].GetNodeSet(f.callgraph) {
-				originalEntityNode[k] = true
+	f.trimLayers()
+	bipartitePhase.Done(round)
+	return nil
+}
+
+// findLayersBipartite searches all layer pairs concurrently, then trims the layers in topological
+// order. The in nodes of a layer are trimmed to the ends of the paths from its previous layers,
+// and its out nodes to the starts of the paths to its next ones, but the example path of a start
+// node does not depend on the other start nodes, so the paths searched from the untrimmed starts
+// are kept for the trimmed ones only.
+func (f *Flow) findLayersBipartite(ctx context.Context) (map[string]bool, error) {
+	issueFuncs := make(map[string]bool)
+	searches := f.getLayerPairSearches()
+	f.resetLayer()
+	if err := f.searchLayerPairs(ctx, searches, true); err != nil {
+		return nil, err
+	}
+	ends := make(map[int]map[*ir.Node]bool)
+	for _, s := range searches {
+		ends[s.pair.To] = make(map[*ir.Node]bool)
+	}
+	for _, i := range f.order {
+		if in, ok := ends[i]; ok {
+			for j, _ := range f.Layers[i].Entities {
+				f.Layers[i].Entities[j].TrimInNodeSet(in, f.callgraph)
 			}
-			f.Layers[i].Entities[j].UpdateInSiteNodeSetWithNodeSet(f.callgraph)
-			f.Layers[i].Entities[j].TrimInNodeSet(originalEntityIn, f.callgraph)
-			f.Layers[i].Entities[j].TrimNodeSet(originalEntityNode, f.callgraph)
 		}
-		if i == 0 {
-			break
-		}
-		filterOutSet := make(map[*ir.Node]bool)
-		for k, _ := range f.Layers[i-1].ExamplePath {
-			for k2, _ := range f.Layers[i-1].ExamplePath[k] {
-				if f.Layers[i].GetInAllNodeSetOnlyRead(f.callgraph) != nil &&
-					f.Layers[i].GetInAllNodeSetOnlyRead(f.callgraph)[k2] {
-					continue
+		starts := make(map[*ir.Node]bool)
+		hasOutPairs := false
+		for _, s := range searches {
+			if s.pair.From != i {
+				continue
+			}
+			hasOutPairs = true
+			examplePath := make(map[*ir.Node]map[*ir.Node][]*ir.Edge)
+			for k, _ := range f.Layers[i].GetOutAllNodeSet(f.callgraph) {
+				if ep, ok := s.examplePath[k]; ok {
+					examplePath[k] = ep
 				}
-				delete(f.Layers[i-1].ExamplePath[k], k2)
 			}
-			if len(f.Layers[i-1].ExamplePath[k]) == 0 {
-				delete(f.Layers[i-1].ExamplePath, k)
+			s.pair.ExamplePath = examplePath
+			for _, v := range examplePath {
+				for _, v2 := range v {
+					isCheckPass, issueFunc := f.checkCallEdgeChain(v2)
+					if !isCheckPass && issueFunc != nil {
+						issueFuncs[issueFunc.Addr] = true
+					}
+				}
+			}
+			pairStarts, pairEnds := GetStartAndEndFromExamplePath(examplePath)
+			for k, _ := range pairStarts {
+				starts[k] = true
+			}
+			for k, _ := range pairEnds {
+				ends[s.pair.To][k] = true
 			}
 		}
-		for k, _ := range f.Layers[i-1].ExamplePath {
-			filterOutSet[k] = true
+		if !hasOutPairs {
+			for j, _ := range f.Layers[i].Entities {
+				f.Layers[i].Entities[j].UpdateOutSiteNodeSetWithNodeSet(f.callgraph)
+			}
+			continue
 		}
-		for j, _ := range f.Layers[i-1].Entities {
-			f.Layers[i-1].Entities[j].TrimOutNodeSet(filterOutSet, f.callgraph)
+		for j, _ := range f.Layers[i].Entities {
+			f.Layers[i].Entities[j].TrimOutNodeSet(starts, f.callgraph)
+		}
+		if _, ok := ends[i]; !ok {
+			for j, _ := range f.Layers[i].Entities {
+				f.Layers[i].Entities[j].UpdateInSiteNodeSetWithNodeSet(f.callgraph)
+			}
 		}
 	}
-	return nil
-}
-
-func (f *Flow) skipNodesIR(issueFuncs map[string]bool) {
-	hasDoSkip := true
-	for hasDoSkip {
-		_, hasDoSkip = f.skipNodeIR(issueFuncs)
-	}
+	return issueFuncs, nil
 }
 
-func (f *Flow) skipNodeIR(issueFuncs map[string]bool) (hasFound, hasDoSkip bool) {
-	isFuncTarget := func(name string) bool {
-		for k, _ := range issueFuncs {
-			if k == name {
-				return true
+// trimLayers trims the entities and example paths of every layer backward, so that only
+// the nodes connected to its next layers remain.
+func (f *Flow) trimLayers() {
+	for k := len(f.order) - 1; k >= 0; k-- {
+		i := f.order[k]
+		if len(f.getOutPairs(i)) > 0 {
+			for j, _ := range f.Layers[i].Entities {
+				originalEntityIn := make(map[*ir.Node]bool)
+				for k, _ := range f.Layers[i].Entities[j].GetInAllNodeSetOnlyRead(f.callgraph) {
+					originalEntityIn[k] = true
+				}
+				originalEntityNode := make(map[*ir.Node]bool)
+				for k, _ := range f.Layers[i].Entities[j].GetNodeSet(f.callgraph) {
+					originalEntityNode[k] = true
+				}
+				f.Layers[i].Entities[j].UpdateInSiteNodeSetWithNodeSet(f.callgraph)
+				f.Layers[i].Entities[j].TrimInNodeSet(originalEntityIn, f.callgraph)
+				f.Layers[i].Entities[j].TrimNodeSet(originalEntityNode, f.callgraph)
 			}
 		}
-		return false
-	}
-	var nodeToSkip *ir.Node
-	for k, v := range f.callgraph.Nodes {
-		if v.Func != nil && isFuncTarget(k) {
-			nodeToSkip = v
-			break
+		inPairs := f.getInPairs(i)
+		for _, p := range inPairs {
+			for k, _ := range p.ExamplePath {
+				for k2, _ := range p.ExamplePath[k] {
+					if f.Layers[i].GetInAllNodeSetOnlyRead(f.callgraph) != nil &&
+						f.Layers[i].GetInAllNodeSetOnlyRead(f.callgraph)[k2] {
+						continue
+					}
+					delete(p.ExamplePath[k], k2)
+				}
+				if len(p.ExamplePath[k]) == 0 {
+					delete(p.ExamplePath, k)
+				}
+			}
+		}
+		// the out nodes of a former layer may start paths to other layers, so they are trimmed
+		// to the starts of all its pairs
+		for _, p := range inPairs {
+			filterOutSet := f.getPairStarts(p.From)
+			for j, _ := range f.Layers[p.From].Entities {
+				f.Layers[p.From].Entities[j].TrimOutNodeSet(filterOutSet, f.callgraph)
+			}
 		}
 	}
-	if nodeToSkip == nil {
-		return false, false
+}
+
+// skipNodesIR deletes the nodes of issueFuncs, splicing their in and out edges where needed.
+// The nodes are looked up by address, so it costs O(degree) per issue func.
+func (f *Flow) skipNodesIR(issueFuncs map[string]bool) {
+	for k, _ := range issueFuncs {
+		if nodeToSkip, ok := f.callgraph.Nodes[k]; ok && nodeToSkip.Func != nil {
+			f.skipNodeIR(nodeToSkip, issueFuncs)
+		}
 	}
-	hasFound = true
+}
+
+func (f *Flow) skipNodeIR(nodeToSkip *ir.Node, issueFuncs map[string]bool) {
 	cacheIn := make([]*ir.Edge, 0)
 	cacheOut := make([]*ir.Edge, 0)
 	for _, v := range nodeToSkip.In {
@@ -194,26 +259,23 @@ func (f *Flow) skipNodeIR(issueFuncs map[string]bool) (hasFound, hasDoSkip bool)
 			inCallerFuncAddr := in.Caller.Func.Addr
 			outCalleeFuncAddr := out.Callee.Func.Addr
 			doMerge := false
-			if isFuncTarget(outCalleeFuncAddr) || isFuncTarget(inCallerFuncAddr) {
+			if issueFuncs[outCalleeFuncAddr] || issueFuncs[inCallerFuncAddr] {
 				doMerge = true
 			}
 			if out.Callee.Func.Parent != nil && out.Callee.Func.Parent.Name == in.Caller.Func.Name {
 				doMerge = true
 			}
-			mergedSite := &ir.Site{
-				Name: fmt.Sprintf("%s->Skip(%s)->%s", in.Site.Name, nodeToSkip.Func.Name, out.Site.Name),
-				Addr: fmt.Sprintf("%s->Skip(%s)->%s", in.Site.Addr, nodeToSkip.Func.Addr, out.Site.Addr),
+			if !doMerge {
+				continue
 			}
-			if doMerge {
-				f.callgraph.AddEdge(inCallerFuncAddr, outCalleeFuncAddr, mergedSite)
-				hasDoSkip = true
+			mergedSite := &ir.Site{
+				Name:    fmt.Sprintf("%s->Skip(%s)->%s", in.Site.Name, nodeToSkip.Func.Name, out.Site.Name),
+				Addr:    fmt.Sprintf("%s->Skip(%s)->%s", in.Site.Addr, nodeToSkip.Func.Addr, out.Site.Addr),
+				Configs: ir.IntersectConfigs(in.Site.Configs, out.Site.Configs),
 			}
+			f.callgraph.AddEdge(inCallerFuncAddr, outCalleeFuncAddr, mergedSite)
 		}
 	}
-	if !hasDoSkip && hasFound {
-		return f.skipNodeIR(issueFuncs)
-	}
-	return hasFound, hasDoSkip
 }
 
 func (f *Flow) checkCallEdgeChain(path []*ir.Edge) (isCheckPass bool, issueFunc *ir.Func) {
@@ -253,54 +315,294 @@ func (f *Flow) checkCallEdgeChain(path []*ir.Edge) (isCheckPass bool, issueFunc
 	return true, nil
 }
 
-func (f *Flow) findReachableNodesIR(starts map[*ir.Node]bool, ends map[*ir.Node]bool,
-	innerContainSet map[*ir.Node]bool) (containSet map[*ir.Node]bool, examplePath map[*ir.Node]map[*ir.Node][]*ir.Edge) {
-	containSet = f.searchReachableNodesFromEnds(ends, innerContainSet)
-	containSet = f.searchReachableNodesFromStarts(starts, containSet)
-	examplePath = make(map[*ir.Node]map[*ir.Node][]*ir.Edge)
-	for k, _ := range starts {
-		ep := f.findExamplePath(k, ends, containSet)
-		if len(ep) > 0 {
-			examplePath[k] = ep
-		}
-	}
-	return containSet, examplePath
+// layerPairSearch is the reachability search between the out nodes of a layer and the in nodes
+// of a later one, avoiding the nodes of the layers it skips and the avoid of the pair.
+type layerPairSearch struct {
+	pair       *LayerPair
+	starts     map[*ir.Node]bool
+	ends       map[*ir.Node]bool
+	avoidSet   map[*ir.Node]bool
+	containSet map[*ir.Node]bool
+	// waypoints are the nodes of the via of the pair. The search is split at them into segments,
+	// the nodes on the paths from the starts or a waypoint to the next waypoint or the ends.
+	waypoints   []map[*ir.Node]bool
+	segments    []map[*ir.Node]bool
+	examplePath map[*ir.Node]map[*ir.Node][]*ir.Edge
+}
+
+func (f *Flow) getLayerPairSearches() []*layerPairSearch {
+	searches := make([]*layerPairSearch, 0)
+	for _, p := range f.Pairs {
+		s := &layerPairSearch{
+			pair:   p,
+			starts: f.Layers[p.From].GetOutAllNodeSet(f.callgraph),
+			ends:   f.Layers[p.To].GetInAllNodeSet(f.callgraph),
+		}
+		if p.IsSkip() || p.Avoid != nil {
+			s.avoidSet = make(map[*ir.Node]bool)
+			for _, k := range p.Skipped {
+				for n, _ := range f.Layers[k].GetNodeSet(f.callgraph) {
+					s.avoidSet[n] = true
+				}
+			}
+			for n, _ := range f.getMatchedNodeSet(p.Avoid) {
+				s.avoidSet[n] = true
+			}
+		}
+		for _, m := range p.Via {
+			waypoints := f.getMatchedNodeSet(m)
+			for n, _ := range s.avoidSet {
+				delete(waypoints, n)
+			}
+			s.waypoints = append(s.waypoints, waypoints)
+		}
+		searches = append(searches, s)
+	}
+	return searches
+}
+
+// getMatchedNodeSet returns the nodes of the funcs whose name m matches.
+func (f *Flow) getMatchedNodeSet(m *mode.Mode) map[*ir.Node]bool {
+	nodeSet := make(map[*ir.Node]bool)
+	if m == nil {
+		return nodeSet
+	}
+	for _, n := range f.callgraph.Nodes {
+		if n.Func != nil && n.Func.Name != "" && m.Match(n.Func.Name) {
+			nodeSet[n] = true
+		}
+	}
+	return nodeSet
+}
+
+// searchLayerPairs runs the searches with at most f.parallel workers. The callgraph is only
+// read, all search state lives in the searches.
+func (f *Flow) searchLayerPairs(ctx context.Context, searches []*layerPairSearch, withExamplePath bool) error {
+	err := f.runParallel(ctx, len(searches), func(i int) error {
+		s := searches[i]
+		if len(s.waypoints) > 0 {
+			return s.searchWaypoints(ctx)
+		}
+		// the search from the starts stays in the contain set, which has no avoided nodes
+		containSet, err := searchReachableNodesFromEnds(ctx, s.ends, nil, s.avoidSet)
+		if err != nil {
+			return err
+		}
+		s.containSet, err = searchReachableNodesFromStarts(ctx, s.starts, containSet)
+		return err
+	})
+	if err != nil || !withExamplePath {
+		return err
+	}
+	type startTask struct {
+		search *layerPairSearch
+		start  *ir.Node
+	}
+	tasks := make([]startTask, 0)
+	for _, s := range searches {
+		for k, _ := range s.starts {
+			tasks = append(tasks, startTask{search: s, start: k})
+		}
+	}
+	examplePaths := make([]map[*ir.Node][]*ir.Edge, len(tasks))
+	err = f.runParallel(ctx, len(tasks), func(i int) error {
+		var err error
+		s := tasks[i].search
+		if len(s.waypoints) > 0 {
+			examplePaths[i], err = s.findExamplePathVia(ctx, tasks[i].start)
+			return err
+		}
+		examplePaths[i], err = findExamplePath(ctx, tasks[i].start, s.ends, s.containSet)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range searches {
+		s.examplePath = make(map[*ir.Node]map[*ir.Node][]*ir.Edge)
+	}
+	for i, t := range tasks {
+		if len(examplePaths[i]) > 0 {
+			t.search.examplePath[t.start] = examplePaths[i]
+		}
+	}
+	return nil
 }
 
-func (f *Flow) findExamplePath(src *ir.Node, dsts map[*ir.Node]bool,
-	containSet map[*ir.Node]bool) (examplePath map[*ir.Node][]*ir.Edge) {
+// runParallel calls fn for 0..n-1 with at most f.parallel workers and returns the first error.
+// No more calls are started once an error occurred or ctx is done.
+func (f *Flow) runParallel(ctx context.Context, n int, fn func(i int) error) error {
+	if f.parallel <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sem := make(chan struct{}, f.parallel)
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(i); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// searchWaypoints searches the segments of the paths through the waypoints in order. The nodes
+// each segment can reach the valid targets from are searched backward from the ends, then the
+// segments are searched forward from the starts, each one from the waypoints reached by the
+// previous one. The contain set is the union of the segments.
+func (s *layerPairSearch) searchWaypoints(ctx context.Context) error {
+	n := len(s.waypoints) + 1
+	sources := append([]map[*ir.Node]bool{s.starts}, s.waypoints...)
+	reachables := make([]map[*ir.Node]bool, n)
+	targets := s.ends
+	for t := n - 1; t >= 0; t-- {
+		reachables[t] = make(map[*ir.Node]bool)
+		if len(targets) > 0 {
+			reachable, err := searchReachableNodesFromEnds(ctx, targets, nil, s.avoidSet)
+			if err != nil {
+				return err
+			}
+			reachables[t] = reachable
+		}
+		targets = intersectNodeSets(sources[t], reachables[t])
+	}
+	s.segments = make([]map[*ir.Node]bool, n)
+	s.containSet = make(map[*ir.Node]bool)
+	current := targets
+	for t := 0; t < n; t++ {
+		s.segments[t] = make(map[*ir.Node]bool)
+		if len(current) > 0 {
+			segment, err := searchReachableNodesFromStarts(ctx, current, reachables[t])
+			if err != nil {
+				return err
+			}
+			s.segments[t] = segment
+		}
+		for k, _ := range s.segments[t] {
+			s.containSet[k] = true
+		}
+		if t < n-1 {
+			current = intersectNodeSets(s.waypoints[t], s.segments[t])
+		}
+	}
+	return nil
+}
+
+// findExamplePathVia finds the example paths from src to the ends through the waypoints, joining
+// the paths of the segments.
+func (s *layerPairSearch) findExamplePathVia(ctx context.Context, src *ir.Node) (map[*ir.Node][]*ir.Edge, error) {
+	paths := map[*ir.Node][]*ir.Edge{src: nil}
+	var err error
+	for t, waypoints := range s.waypoints {
+		if len(s.segments[t]) == 0 {
+			return nil, nil
+		}
+		// a waypoint may be reached by a path through another one
+		paths, err = findPaths(ctx, paths, waypoints, s.segments[t], false)
+		if err != nil || len(paths) == 0 {
+			return nil, err
+		}
+	}
+	if len(s.segments[len(s.waypoints)]) == 0 {
+		return nil, nil
+	}
+	return findPaths(ctx, paths, s.ends, s.segments[len(s.waypoints)], true)
+}
+
+func findExamplePath(ctx context.Context, src *ir.Node, dsts map[*ir.Node]bool,
+	containSet map[*ir.Node]bool) (examplePath map[*ir.Node][]*ir.Edge, err error) {
+	return findPaths(ctx, map[*ir.Node][]*ir.Edge{src: nil}, dsts, containSet, true)
+}
+
+// findPaths searches the shortest paths to dsts in containSet from the sources, which start with
+// the paths leading to them. Sources with shorter paths are searched first, ties by address.
+// Unless nonEmpty, a source in dsts is reached by its own path, and dsts are passed on.
+func findPaths(ctx context.Context, srcs map[*ir.Node][]*ir.Edge, dsts map[*ir.Node]bool,
+	containSet map[*ir.Node]bool, nonEmpty bool) (examplePath map[*ir.Node][]*ir.Edge, err error) {
 	examplePath = make(map[*ir.Node][]*ir.Edge)
 	q := queue.New[*ir.Node]()
-	visited := make(map[*ir.Node]bool)
-	visited[src] = true
-	q.Add(src)
-	for q.Length() > 0 {
+	paths := make(map[*ir.Node][]*ir.Edge)
+	sorted := make([]*ir.Node, 0, len(srcs))
+	for k, _ := range srcs {
+		sorted = append(sorted, k)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(srcs[sorted[i]]) != len(srcs[sorted[j]]) {
+			return len(srcs[sorted[i]]) < len(srcs[sorted[j]])
+		}
+		return getNodeAddr(sorted[i]) < getNodeAddr(sorted[j])
+	})
+	for _, k := range sorted {
+		paths[k] = srcs[k]
+		q.Add(k)
+	}
+	for removed := 1; q.Length() > 0; removed++ {
+		if removed%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		node := q.Remove()
-		if dsts[node] && len(node.GetPath()) > 0 {
-			examplePath[node] = node.GetPath()
-			continue
+		if dsts[node] && (!nonEmpty || len(paths[node]) > 0) {
+			examplePath[node] = paths[node]
+			if nonEmpty {
+				continue
+			}
 		}
 		for _, e := range node.Out {
 			w := e.Callee
 			if len(containSet) == 0 || (len(containSet) != 0 && containSet[w]) {
-				if _, ok := visited[w]; ok {
+				if _, ok := paths[w]; ok {
 					continue
 				}
-				newPath := make([]*ir.Edge, 0)
-				newPath = append(newPath, node.GetPath()...)
-				w.SetPath(append(newPath, e))
-				visited[w] = true
+				newPath := make([]*ir.Edge, 0, len(paths[node])+1)
+				newPath = append(newPath, paths[node]...)
+				paths[w] = append(newPath, e)
 				q.Add(w)
 			}
 		}
 	}
-	for _, v := range f.callgraph.Nodes {
-		v.ClearPath()
+	return examplePath, nil
+}
+
+func intersectNodeSets(a, b map[*ir.Node]bool) map[*ir.Node]bool {
+	intersection := make(map[*ir.Node]bool)
+	for k, _ := range a {
+		if b[k] {
+			intersection[k] = true
+		}
 	}
-	return examplePath
+	return intersection
 }
 
-func (f *Flow) searchReachableNodesFromEnds(ends map[*ir.Node]bool, containSet map[*ir.Node]bool) map[*ir.Node]bool {
+func searchReachableNodesFromEnds(ctx context.Context, ends map[*ir.Node]bool, containSet map[*ir.Node]bool,
+	avoidSet map[*ir.Node]bool) (map[*ir.Node]bool, error) {
 	var (
 		visited = make(map[*ir.Node]bool)
 		q       = queue.New[*ir.Node]()
@@ -315,12 +617,18 @@ func (f *Flow) searchReachableNodesFromEnds(ends map[*ir.Node]bool, containSet m
 		visited[nodes] = true
 	}
 	for q.Length() > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		innerLayerCount := 0
 		stepMap := make(map[*ir.Node]bool)
 		for i := 0; i < layerCount; i++ {
 			v := q.Remove()
 			for _, edge := range v.In {
 				w := edge.Caller
+				if avoidSet[w] {
+					continue
+				}
 				if len(containSet) == 0 || (len(containSet) != 0 && containSet[w]) {
 					if _, ok := visited[w]; ok {
 						continue
@@ -337,10 +645,10 @@ func (f *Flow) searchReachableNodesFromEnds(ends map[*ir.Node]bool, containSet m
 			layerList = append(layerList, stepMap)
 		}
 	}
-	return visited
+	return visited, nil
 }
 
-func (f *Flow) searchReachableNodesFromStarts(starts map[*ir.Node]bool, containSet map[*ir.Node]bool) map[*ir.Node]bool {
+func searchReachableNodesFromStarts(ctx context.Context, starts map[*ir.Node]bool, containSet map[*ir.Node]bool) (map[*ir.Node]bool, error) {
 	var (
 		visited = make(map[*ir.Node]bool)
 		q       = queue.New[*ir.Node]()
@@ -355,6 +663,9 @@ func (f *Flow) searchReachableNodesFromStarts(starts map[*ir.Node]bool, containS
 		visited[nodes] = true
 	}
 	for q.Length() > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		innerLayerCount := 0
 		stepMap := make(map[*ir.Node]bool)
 		for i := 0; i < layerCount; i++ {
@@ -377,5 +688,5 @@ func (f *Flow) searchReachableNodesFromStarts(starts map[*ir.Node]bool, containS
 			layerList = append(layerList, stepMap)
 		}
 	}
-	return visited
+	return visited, nil
 }
@@ -0,0 +1,377 @@
+package flow
+
+import (
+	"fmt"
+	"github.com/laindream/go-callflow-vis/config"
+	"github.com/laindream/go-callflow-vis/ir"
+	"github.com/laindream/go-callflow-vis/mode"
+	"github.com/laindream/go-callflow-vis/util"
+	"io"
+	"sort"
+	"strings"
+)
+
+// nearMissCount is the number of near misses suggested for an entity matching nothing.
+const nearMissCount = 5
+
+// Explain writes what the focus and ignore rules and the entities of the layers match, without
+// generating the flow. The rules are matched on rawGraph, which is the callgraph before focus and
+// ignore, and the entities on filteredGraph. If rawGraph is nil, the rules are matched on
+// filteredGraph. At most limit functions or sites are listed per match, 0 lists all.
+func Explain(w io.Writer, conf *config.Config, rawGraph, filteredGraph *ir.Callgraph, limit int) error {
+	if conf == nil {
+		return fmt.Errorf("config is nil")
+	}
+	if filteredGraph == nil {
+		return fmt.Errorf("callgraph is nil")
+	}
+	e := &explainer{sb: &strings.Builder{}, limit: limit}
+	e.writeRules(conf, rawGraph, filteredGraph)
+	for i, l := range conf.Layers {
+		e.printf("\n== layer[%d] %s ==\n", i, l.Name)
+		for j, entity := range l.Entities {
+			e.writeEntity(fmt.Sprintf("entities[%d]", j), &Entity{Entity: entity}, rawGraph, filteredGraph)
+		}
+	}
+	_, err := io.WriteString(w, e.sb.String())
+	return err
+}
+
+type explainer struct {
+	sb    *strings.Builder
+	limit int
+}
+
+func (e *explainer) printf(format string, a ...interface{}) {
+	_, _ = fmt.Fprintf(e.sb, format, a...)
+}
+
+func (e *explainer) writeRules(conf *config.Config, rawGraph, filteredGraph *ir.Callgraph) {
+	graph := rawGraph
+	if graph == nil {
+		graph = filteredGraph
+	}
+	names := getFuncNames(graph)
+	e.printf("== focus and ignore ==\n")
+	if rawGraph == nil {
+		e.printf("the callgraph before focus and ignore is not cached, the rules are matched on the filtered one\n")
+	}
+	e.printf("%d funcs, %d kept by focus and ignore\n", len(names), len(getFuncNames(filteredGraph)))
+	for _, set := range []struct {
+		key   string
+		modes mode.Set
+	}{
+		{"focus", conf.Focus},
+		{"ignore", conf.Ignore},
+	} {
+		if len(set.modes) == 0 {
+			e.printf("%s: none\n", set.key)
+			continue
+		}
+		for i, m := range set.modes {
+			matched := e.writeMode(0, fmt.Sprintf("%s[%d]", set.key, i), m, names, "funcs")
+			e.writeList(1, matched)
+		}
+	}
+}
+
+func (e *explainer) writeEntity(key string, entity *Entity, rawGraph, filteredGraph *ir.Callgraph) {
+	nodes := getSortedNodes(entity.GetNodeSet(filteredGraph))
+	e.printf("%s %s: %d funcs\n", key, entity.String(), len(nodes))
+	names, origins, signatures := make([]string, 0), make([]string, 0), make([]string, 0)
+	for _, n := range getGraphNodes(filteredGraph) {
+		names = append(names, n.Func.Name)
+		origins = append(origins, n.Func.GetOriginName())
+		signatures = append(signatures, n.Func.Signature)
+	}
+	sites := getSiteNames(filteredGraph)
+	components := []struct {
+		key    string
+		mode   *mode.Mode
+		values []string
+		unit   string
+	}{
+		{"name", entity.Name, names, "funcs"},
+		{"origin", entity.Origin, origins, "funcs"},
+		{"signature", entity.Signature, signatures, "funcs"},
+		{"in_site", entity.InSite, sites, "sites"},
+		{"out_site", entity.OutSite, sites, "sites"},
+	}
+	for _, c := range components {
+		if c.mode != nil {
+			e.writeMode(1, c.key, c.mode, c.values, c.unit)
+		}
+	}
+	if len(nodes) > 0 {
+		e.printf("    funcs:\n")
+		e.writeNodes(2, entity, nodes)
+		return
+	}
+	if rawGraph != nil && rawGraph != filteredGraph {
+		rawNodes := getSortedNodes((&Entity{Entity: entity.Entity}).GetNodeSet(rawGraph))
+		if len(rawNodes) > 0 {
+			e.printf("    %d funcs match before focus and ignore, which leave them out:\n", len(rawNodes))
+			e.writeList(2, getNodeNames(rawNodes))
+		}
+	}
+	for _, c := range components {
+		if c.mode == nil {
+			continue
+		}
+		nearMisses := getNearMisses(c.mode, c.values, c.key == "name" || c.key == "origin")
+		if len(nearMisses) == 0 {
+			e.printf("    no near misses by %s\n", c.key)
+			continue
+		}
+		e.printf("    near misses by %s:\n", c.key)
+		for _, nm := range nearMisses {
+			e.printf("        %s (distance %d)\n", nm.value, nm.distance)
+		}
+	}
+}
+
+// writeMode writes the number of values matched by the mode and by each of its rules, and returns
+// the matched values.
+func (e *explainer) writeMode(depth int, key string, m *mode.Mode, values []string, unit string) []string {
+	indent := strings.Repeat("    ", depth)
+	matched := make([]string, 0)
+	for _, v := range values {
+		if m.Match(v) {
+			matched = append(matched, v)
+		}
+	}
+	not := ""
+	if m.Not {
+		not = " (not)"
+	}
+	e.printf("%s%s%s: %d %s\n", indent, key, not, len(matched), unit)
+	for i, _ := range m.Rules {
+		count := 0
+		for _, v := range values {
+			if m.Rules[i].Match(v) {
+				count++
+			}
+		}
+		e.printf("%s    rules[%d] %s: %d %s\n", indent, i, m.Rules[i].String(), count, unit)
+	}
+	return matched
+}
+
+// writeNodes lists the funcs of the entity with the in and out sites matched by it.
+func (e *explainer) writeNodes(depth int, entity *Entity, nodes []*ir.Node) {
+	indent := strings.Repeat("    ", depth)
+	for i, n := range nodes {
+		if e.limit > 0 && i == e.limit {
+			e.printf("%s... %d more\n", indent, len(nodes)-i)
+			return
+		}
+		e.printf("%s%s\n", indent, n.Func.Name)
+		if entity.InSite != nil {
+			lines := make([]string, 0)
+			for _, edge := range n.In {
+				if isSiteMatchIR(edge.Site, entity.InSite) {
+					lines = append(lines, fmt.Sprintf("in from %s at %s", edge.Caller.Func.Name, edge.Site.Name))
+				}
+			}
+			e.writeList(depth+1, lines)
+		}
+		if entity.OutSite != nil {
+			lines := make([]string, 0)
+			for _, edge := range n.Out {
+				if isSiteMatchIR(edge.Site, entity.OutSite) {
+					lines = append(lines, fmt.Sprintf("out to %s at %s", edge.Callee.Func.Name, edge.Site.Name))
+				}
+			}
+			e.writeList(depth+1, lines)
+		}
+	}
+}
+
+func (e *explainer) writeList(depth int, lines []string) {
+	indent := strings.Repeat("    ", depth)
+	for i, line := range lines {
+		if e.limit > 0 && i == e.limit {
+			e.printf("%s... %d more\n", indent, len(lines)-i)
+			return
+		}
+		e.printf("%s%s\n", indent, line)
+	}
+}
+
+type nearMiss struct {
+	value    string
+	distance int
+}
+
+// getNearMisses returns the values closest to the rules of the mode which are not negated, by
+// the edit distance of their content to the part of the value the rule matches. funcNames tells
+// the values are function names, which the component match types are applied to.
+func getNearMisses(m *mode.Mode, values []string, funcNames bool) []*nearMiss {
+	if m.Not {
+		return nil
+	}
+	rules := getPositiveRules(m.Rules)
+	nearMisses := make([]*nearMiss, 0)
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		best := -1
+		for _, r := range rules {
+			if !funcNames && isComponentType(r.GetType()) {
+				continue
+			}
+			d := getRuleDistance(r, v)
+			if d > maxDistance(r.Content) {
+				continue
+			}
+			if best < 0 || d < best {
+				best = d
+			}
+		}
+		if best >= 0 {
+			nearMisses = append(nearMisses, &nearMiss{value: v, distance: best})
+		}
+	}
+	sort.Slice(nearMisses, func(i, j int) bool {
+		if nearMisses[i].distance != nearMisses[j].distance {
+			return nearMisses[i].distance < nearMisses[j].distance
+		}
+		return nearMisses[i].value < nearMisses[j].value
+	})
+	if len(nearMisses) > nearMissCount {
+		nearMisses = nearMisses[:nearMissCount]
+	}
+	return nearMisses
+}
+
+// getPositiveRules returns the rules with content which are not negated, nested ones included.
+func getPositiveRules(rules []mode.Rule) []*mode.Rule {
+	positive := make([]*mode.Rule, 0)
+	for i, _ := range rules {
+		r := &rules[i]
+		if r.Exclude || r.Not {
+			continue
+		}
+		if len(r.Rules) > 0 {
+			positive = append(positive, getPositiveRules(r.Rules)...)
+			continue
+		}
+		if r.Content != "" {
+			positive = append(positive, r)
+		}
+	}
+	return positive
+}
+
+func isComponentType(t mode.MatchType) bool {
+	return t == mode.MatchTypePackage || t == mode.MatchTypeReceiver || t == mode.MatchTypeMethod
+}
+
+// maxDistance is the largest distance of a near miss to a rule with the content.
+func maxDistance(content string) int {
+	if d := len([]rune(content)) / 3; d > 2 {
+		return d
+	}
+	return 2
+}
+
+func getRuleDistance(r *mode.Rule, s string) int {
+	content := r.Content
+	switch r.GetType() {
+	case mode.MatchTypeIPrefix, mode.MatchTypeISuffix, mode.MatchTypeIContain, mode.MatchTypeIEqual,
+		mode.MatchTypeIRegexp, mode.MatchTypeIGlob:
+		content, s = strings.ToLower(content), strings.ToLower(s)
+	}
+	switch r.GetType() {
+	case mode.MatchTypePrefix, mode.MatchTypeIPrefix:
+		return util.GetPrefixEditDistance(content, s)
+	case mode.MatchTypeSuffix, mode.MatchTypeISuffix:
+		return util.GetPrefixEditDistance(reverse(content), reverse(s))
+	case mode.MatchTypeEqual, mode.MatchTypeIEqual:
+		return util.GetEditDistance(content, s)
+	case mode.MatchTypePackage:
+		pkg, _, _ := util.ParseFuncName(s)
+		return util.GetPrefixEditDistance(reverse(getLiteral(content)), reverse(pkg))
+	case mode.MatchTypeReceiver:
+		_, receiver, _ := util.ParseFuncName(s)
+		return util.GetEditDistance(getLiteral(content), receiver)
+	case mode.MatchTypeMethod:
+		_, _, fn := util.ParseFuncName(s)
+		return util.GetEditDistance(getLiteral(content), fn)
+	}
+	return util.GetSubstringEditDistance(getLiteral(content), s)
+}
+
+// getLiteral drops the glob and regexp metacharacters of the content.
+func getLiteral(content string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`*?^$+()[]{}|\`, r) {
+			return -1
+		}
+		return r
+	}, content)
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+func getFuncNames(graph *ir.Callgraph) []string {
+	if graph == nil {
+		return nil
+	}
+	return getNodeNames(getGraphNodes(graph))
+}
+
+func getNodeNames(nodes []*ir.Node) []string {
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Func.Name)
+	}
+	return names
+}
+
+// getSiteNames returns the names of the call sites of the graph, one per edge.
+func getSiteNames(graph *ir.Callgraph) []string {
+	sites := make([]string, 0)
+	for _, n := range getGraphNodes(graph) {
+		for _, edge := range n.Out {
+			if edge.Site != nil && edge.Site.Name != "" {
+				sites = append(sites, edge.Site.Name)
+			}
+		}
+	}
+	return sites
+}
+
+func getGraphNodes(graph *ir.Callgraph) []*ir.Node {
+	set := make(map[*ir.Node]bool, len(graph.Nodes))
+	for _, n := range graph.Nodes {
+		set[n] = true
+	}
+	return getSortedNodes(set)
+}
+
+// getSortedNodes returns the nodes of the set with a func by name.
+func getSortedNodes(set map[*ir.Node]bool) []*ir.Node {
+	sorted := make([]*ir.Node, 0, len(set))
+	for n, _ := range set {
+		if n != nil && n.Func != nil {
+			sorted = append(sorted, n)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Func.Name != sorted[j].Func.Name {
+			return sorted[i].Func.Name < sorted[j].Func.Name
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
@@ -1,6 +1,7 @@
 package flow
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/awalterschulze/gographviz"
@@ -9,12 +10,43 @@ import (
 	"github.com/laindream/go-callflow-vis/ir"
 	"github.com/laindream/go-callflow-vis/log"
 	"github.com/laindream/go-callflow-vis/mode"
+	"github.com/laindream/go-callflow-vis/progress"
 	"github.com/laindream/go-callflow-vis/render"
 	"github.com/laindream/go-callflow-vis/util"
+	"sort"
 	"strconv"
+	"strings"
 )
 
-func NewFlow(config *config.Config, callGraph *ir.Callgraph, fastMode bool) (*Flow, error) {
+func NewFlow(ctx context.Context, config *config.Config, callGraph *ir.Callgraph, fastMode bool, maxRounds int, parallel int, lowMemory bool) (*Flow, error) {
+	f, err := newFlow(config, callGraph, fastMode, maxRounds, parallel, lowMemory)
+	if err != nil {
+		return nil, err
+	}
+	f.CheckFlowEntities()
+	log.GetLogger().Debugf("NewFlow: Generate Min Graph...")
+	minGraphPhase := progress.GetTracker().Start(progress.PhaseMinGraph)
+	err = f.UpdateMinGraph(ctx)
+	if err != nil {
+		return nil, err
+	}
+	minGraphPhase.Done(len(f.callgraph.Nodes))
+	log.GetLogger().Debugf("NewFlow: Generate Min Graph Nodes:%d", len(f.callgraph.Nodes))
+	return f, f.initRestore()
+}
+
+// NewFlowWithMinGraph creates the flow on the min graph of an earlier NewFlow with the same layers,
+// e.g. a cached one, skipping its computation.
+func NewFlowWithMinGraph(config *config.Config, minGraph *ir.Callgraph, fastMode bool, maxRounds int, parallel int, lowMemory bool) (*Flow, error) {
+	f, err := newFlow(config, minGraph, fastMode, maxRounds, parallel, lowMemory)
+	if err != nil {
+		return nil, err
+	}
+	log.GetLogger().Debugf("NewFlowWithMinGraph: Min Graph Nodes:%d", len(f.callgraph.Nodes))
+	return f, f.initRestore()
+}
+
+func newFlow(config *config.Config, callGraph *ir.Callgraph, fastMode bool, maxRounds int, parallel int, lowMemory bool) (*Flow, error) {
 	if config == nil {
 		return nil, fmt.Errorf("config is nil")
 	}
@@ -38,34 +70,56 @@ func NewFlow(config *config.Config, callGraph *ir.Callgraph, fastMode bool) (*Fl
 		}
 		layers = append(layers, layer)
 	}
-	f := &Flow{
-		pkgPrefix: config.PackagePrefix,
-		callgraph: callGraph,
-		Layers:    layers,
-		fastMode:  fastMode,
-	}
-	f.CheckFlowEntities()
-	log.GetLogger().Debugf("NewFlow: Generate Min Graph...")
-	err := f.UpdateMinGraph()
+	successors, err := config.GetSuccessors()
 	if err != nil {
 		return nil, err
 	}
-	log.GetLogger().Debugf("NewFlow: Generate Min Graph Nodes:%d", len(f.callgraph.Nodes))
-	err = f.initFuryBuffer()
+	order, err := config.GetLayerOrder()
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	pairs := getLayerPairs(config, successors)
+	if err = setPairWaypoints(config, pairs); err != nil {
+		return nil, err
+	}
+	return &Flow{
+		pkgPrefix: config.PackagePrefix,
+		callgraph: callGraph,
+		Layers:    layers,
+		Pairs:     pairs,
+		order:     order,
+		fastMode:  fastMode,
+		maxRounds: maxRounds,
+		parallel:  parallel,
+		lowMemory: lowMemory,
+	}, nil
+}
+
+// initRestore prepares restoring the min graph between bipartite rounds.
+func (f *Flow) initRestore() error {
+	if f.lowMemory {
+		// log the skips instead of keeping a serialized copy of the callgraph to restore
+		f.callgraph.StartChangeLog()
+		return nil
+	}
+	return f.initFuryBuffer()
 }
 
 type Flow struct {
-	pkgPrefix          string
-	furyBuffer         []byte
-	callgraph          *ir.Callgraph
-	allIssueFuncs      map[string]bool
-	Layers             []*Layer
+	pkgPrefix     string
+	furyBuffer    []byte
+	callgraph     *ir.Callgraph
+	allIssueFuncs map[string]bool
+	Layers        []*Layer
+	Pairs         []*LayerPair
+	// order is the topological order of the layers
+	order              []int
 	isCompleteGenerate bool
 	fastMode           bool
+	maxRounds          int
+	parallel           int
+	lowMemory          bool
+	foldGenerics       bool
 }
 
 func (f *Flow) CheckFlowEntities() {
@@ -97,10 +151,13 @@ func (f *Flow) resetLayer() {
 	for _, l := range f.Layers {
 		l.ResetLayer()
 	}
+	for _, p := range f.Pairs {
+		p.ExamplePath = nil
+	}
 }
 
-func (f *Flow) UpdateMinGraph() error {
-	minSet, err := f.GetMinNodeSet()
+func (f *Flow) UpdateMinGraph(ctx context.Context) error {
+	minSet, err := f.GetMinNodeSet(ctx)
 	if err != nil {
 		return err
 	}
@@ -117,13 +174,13 @@ func (f *Flow) UpdateMinGraph() error {
 	return nil
 }
 
-func (f *Flow) Generate() error {
+func (f *Flow) Generate(ctx context.Context) error {
 	log.GetLogger().Debugf("Flow.Generate: Start...")
 	if f.isCompleteGenerate {
 		return nil
 	}
 	f.PrintOriginalFlow()
-	err := f.findAllBipartite(false)
+	err := f.findAllBipartite(ctx)
 	if err != nil {
 		f.reset()
 		return err
@@ -149,54 +206,104 @@ func (f *Flow) PrintFlow() {
 	for i, _ := range f.Layers {
 		inAllNode := len(f.Layers[i].GetInAllNodeSetOnlyRead(f.callgraph))
 		outAllNode := len(f.Layers[i].GetOutAllNodeSetOnlyRead(f.callgraph))
-		start, end := GetStartAndEndFromExamplePath(f.Layers[i].ExamplePath)
-		log.GetLogger().Debugf("Layers[%d] InAllNode:%d, OutAllNode:%d, start:%d, end:%d",
-			i, inAllNode, outAllNode, len(start), len(end))
+		log.GetLogger().Debugf("Layers[%d] InAllNode:%d, OutAllNode:%d", i, inAllNode, outAllNode)
+	}
+	for _, p := range f.Pairs {
+		start, end := GetStartAndEndFromExamplePath(p.ExamplePath)
+		log.GetLogger().Debugf("Layers[%d-%d] Skipped:%v, start:%d, end:%d", p.From, p.To, p.Skipped, len(start), len(end))
 	}
 }
 
+// SavePaths saves the example paths of every layer pair to i-j.csv, i and j being the indexes of
+// its layers.
 func (f *Flow) SavePaths(path string, separator string) error {
 	if separator == "" {
 		separator = ","
 	}
-	for i, _ := range f.Layers {
-		if i == len(f.Layers)-1 {
+	for _, pair := range f.Pairs {
+		if pair.IsSkip() && len(pair.ExamplePath) == 0 {
 			continue
 		}
-		t := fmt.Sprintf("%s%s%s%s%s", "\"Caller\"", separator, "\"Callee\"", separator, "\"ExamplePath\"\n")
-		for from, _ := range f.Layers[i].ExamplePath {
-			for to, p := range f.Layers[i].ExamplePath[from] {
+		withConfigs := len(f.callgraph.Configs) > 1
+		t := fmt.Sprintf("%s%s%s%s%s", "\"Caller\"", separator, "\"Callee\"", separator, "\"ExamplePath\"")
+		if withConfigs {
+			t += fmt.Sprintf("%s%s", separator, "\"Configs\"")
+		}
+		t += "\n"
+		for from, _ := range pair.ExamplePath {
+			for to, p := range pair.ExamplePath[from] {
 				if len(p) == 0 {
 					continue
 				}
 				path := ""
+				var configs []string
 				for _, e := range p {
 					path += fmt.Sprintf("%s", e.ReadableString())
+					if e.Site != nil {
+						configs = ir.IntersectConfigs(configs, e.Site.Configs)
+					}
 				}
 				t += fmt.Sprintf("%s%s%s%s%s", "\""+util.Escape(from.Func.Name)+"\"", separator, "\""+util.Escape(to.Func.Name)+"\"", separator, "\""+util.Escape(path)+"\"")
+				if withConfigs {
+					t += fmt.Sprintf("%s%s", separator, "\""+util.Escape(strings.Join(configs, ","))+"\"")
+				}
 				t += "\n"
 			}
 		}
-		if err := util.WriteToFile(t, fmt.Sprintf("%s/%d-%d.csv", path, i, i+1)); err != nil {
+		if err := util.WriteToFile(t, fmt.Sprintf("%s/%d-%d.csv", path, pair.From, pair.To)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// GetCallgraph returns the callgraph of the flow, which is the min graph until Generate.
+func (f *Flow) GetCallgraph() *ir.Callgraph {
+	return f.callgraph
+}
+
+func (f *Flow) GetUnanalyzed() map[string]string {
+	if f.callgraph == nil {
+		return nil
+	}
+	return f.callgraph.Unanalyzed
+}
+
+func (f *Flow) SaveUnanalyzed(filename string, separator string) error {
+	if separator == "" {
+		separator = ","
+	}
+	unanalyzed := f.GetUnanalyzed()
+	pkgs := make([]string, 0, len(unanalyzed))
+	for k, _ := range unanalyzed {
+		pkgs = append(pkgs, k)
+	}
+	sort.Strings(pkgs)
+	t := fmt.Sprintf("%s%s%s", "\"Package\"", separator, "\"Reason\"\n")
+	for _, pkg := range pkgs {
+		t += fmt.Sprintf("%s%s%s", "\""+util.Escape(pkg)+"\"", separator, "\""+util.Escape(unanalyzed[pkg])+"\"")
+		t += "\n"
+	}
+	return util.WriteToFile(t, filename)
+}
+
 func (f *Flow) GetRenderGraph() *render.Graph {
 	nodes := make(map[string]*render.Node)
 	edges := make(map[string]*render.Edge)
-	for _, l := range f.Layers {
-		for k, _ := range l.ExamplePath {
-			for k2, _ := range l.ExamplePath[k] {
-				for _, e := range l.ExamplePath[k][k2] {
-					edges[e.String()] = e.ToRenderEdge(f.pkgPrefix)
-					nodes[e.Caller.Func.Addr] = e.Caller.ToRenderNode(f.pkgPrefix)
-					nodes[e.Callee.Func.Addr] = e.Callee.ToRenderNode(f.pkgPrefix)
+	skipEdges := f.getSkipEdges()
+	for _, p := range f.Pairs {
+		for k, _ := range p.ExamplePath {
+			for k2, _ := range p.ExamplePath[k] {
+				for _, e := range p.ExamplePath[k][k2] {
+					edges[e.String()] = e.ToRenderEdge(f.pkgPrefix, f.callgraph.Configs)
+					edges[e.String()].Skip = skipEdges[e.String()]
+					nodes[e.Caller.Func.Addr] = e.Caller.ToRenderNode(f.pkgPrefix, f.callgraph.Configs)
+					nodes[e.Callee.Func.Addr] = e.Callee.ToRenderNode(f.pkgPrefix, f.callgraph.Configs)
 				}
 			}
 		}
+	}
+	for _, l := range f.Layers {
 		for k, _ := range l.GetInToOutEdgeSet(f.callgraph) {
 			for k2, _ := range l.GetInToOutEdgeSet(f.callgraph)[k] {
 				for _, e := range l.GetInToOutEdgeSet(f.callgraph)[k][k2] {
@@ -205,23 +312,25 @@ func (f *Flow) GetRenderGraph() *render.Graph {
 							continue
 						}
 						if e2.Callee == nil && e2.Caller != nil {
-							nodes[e2.Caller.Func.Addr] = e2.Caller.ToRenderNode(f.pkgPrefix)
+							nodes[e2.Caller.Func.Addr] = e2.Caller.ToRenderNode(f.pkgPrefix, f.callgraph.Configs)
 							continue
 						}
 						if e2.Callee != nil && e2.Caller == nil {
-							nodes[e2.Callee.Func.Addr] = e2.Callee.ToRenderNode(f.pkgPrefix)
+							nodes[e2.Callee.Func.Addr] = e2.Callee.ToRenderNode(f.pkgPrefix, f.callgraph.Configs)
 							continue
 						}
-						edges[e2.String()] = e2.ToRenderEdge(f.pkgPrefix)
-						nodes[e2.Caller.Func.Addr] = e2.Caller.ToRenderNode(f.pkgPrefix)
-						nodes[e2.Callee.Func.Addr] = e2.Callee.ToRenderNode(f.pkgPrefix)
+						edges[e2.String()] = e2.ToRenderEdge(f.pkgPrefix, f.callgraph.Configs)
+						nodes[e2.Caller.Func.Addr] = e2.Caller.ToRenderNode(f.pkgPrefix, f.callgraph.Configs)
+						nodes[e2.Callee.Func.Addr] = e2.Callee.ToRenderNode(f.pkgPrefix, f.callgraph.Configs)
 					}
 				}
 			}
 		}
 	}
-	setIndex := 0
-	for _, l := range f.Layers {
+	// the sets of the layers at the same depth, e.g. the branches of a fork, share the groups
+	groups := make(map[int]map[*ir.Node]bool)
+	depths := f.getLayerDepths()
+	for i, l := range f.Layers {
 		layerInSet := make(map[*ir.Node]bool)
 		layerNodeSet := make(map[*ir.Node]bool)
 		layerOutSet := make(map[*ir.Node]bool)
@@ -236,27 +345,31 @@ func (f *Flow) GetRenderGraph() *render.Graph {
 				layerOutSet[n] = true
 			}
 		}
-		if len(layerInSet) > 0 {
-			for n, _ := range layerInSet {
-				nodes[n.Func.Addr] = n.ToRenderNode(f.pkgPrefix)
-				nodes[n.Func.Addr].Set = setIndex
+		for k, set := range []map[*ir.Node]bool{layerInSet, layerNodeSet, layerOutSet} {
+			group := depths[i]*3 + k
+			if groups[group] == nil {
+				groups[group] = make(map[*ir.Node]bool)
 			}
-			setIndex++
-		}
-		if len(layerNodeSet) > 0 {
-			for n, _ := range layerNodeSet {
-				nodes[n.Func.Addr] = n.ToRenderNode(f.pkgPrefix)
-				nodes[n.Func.Addr].Set = setIndex
+			for n, _ := range set {
+				groups[group][n] = true
 			}
-			setIndex++
 		}
-		if len(layerOutSet) > 0 {
-			for n, _ := range layerOutSet {
-				nodes[n.Func.Addr] = n.ToRenderNode(f.pkgPrefix)
-				nodes[n.Func.Addr].Set = setIndex
-			}
-			setIndex++
+	}
+	groupKeys := make([]int, 0, len(groups))
+	for k, _ := range groups {
+		groupKeys = append(groupKeys, k)
+	}
+	sort.Ints(groupKeys)
+	setIndex := 0
+	for _, k := range groupKeys {
+		if len(groups[k]) == 0 {
+			continue
+		}
+		for n, _ := range groups[k] {
+			nodes[n.Func.Addr] = n.ToRenderNode(f.pkgPrefix, f.callgraph.Configs)
+			nodes[n.Func.Addr].Set = setIndex
 		}
+		setIndex++
 	}
 	nodeSet := make([]*render.Node, 0)
 	for _, n := range nodes {
@@ -266,6 +379,9 @@ func (f *Flow) GetRenderGraph() *render.Graph {
 	for _, e := range edges {
 		edgeSet = append(edgeSet, e)
 	}
+	if f.foldGenerics {
+		nodeSet, edgeSet = f.foldRenderGraph(nodeSet, edgeSet)
+	}
 	return &render.Graph{
 		NodeSet: nodeSet,
 		EdgeSet: edgeSet,
@@ -281,26 +397,33 @@ func (f *Flow) GetDot(isSimple bool) string {
 	mainGraph.AddAttr(graphName, "newrank", "true")
 	nodes := make(map[string]*ir.Node)
 	edges := make(map[string]*ir.Edge)
-	for _, l := range f.Layers {
-		for k, _ := range l.ExamplePath {
-			for k2, _ := range l.ExamplePath[k] {
+	foldedIDs := f.getFoldedIDs()
+	skipEdges := f.getSkipEdges()
+	for _, p := range f.Pairs {
+		for k, _ := range p.ExamplePath {
+			for k2, _ := range p.ExamplePath[k] {
 				if isSimple {
-					simpleEdge := getSimpleEdgeForPath(l.ExamplePath[k][k2])
+					simpleEdge := getSimpleEdgeForPath(p.ExamplePath[k][k2])
 					if simpleEdge == nil {
 						continue
 					}
 					edges[simpleEdge.String()] = simpleEdge
+					if isSkip, ok := skipEdges[simpleEdge.String()]; !ok || isSkip {
+						skipEdges[simpleEdge.String()] = p.IsSkip()
+					}
 					nodes[simpleEdge.Caller.Func.Addr] = simpleEdge.Caller
 					nodes[simpleEdge.Callee.Func.Addr] = simpleEdge.Callee
 					continue
 				}
-				for _, e := range l.ExamplePath[k][k2] {
+				for _, e := range p.ExamplePath[k][k2] {
 					edges[e.String()] = e
 					nodes[e.Caller.Func.Addr] = e.Caller
 					nodes[e.Callee.Func.Addr] = e.Callee
 				}
 			}
 		}
+	}
+	for _, l := range f.Layers {
 		for k, _ := range l.GetInToOutEdgeSet(f.callgraph) {
 			for k2, _ := range l.GetInToOutEdgeSet(f.callgraph)[k] {
 				for _, e := range l.GetInToOutEdgeSet(f.callgraph)[k][k2] {
@@ -328,20 +451,31 @@ func (f *Flow) GetDot(isSimple bool) string {
 		if n.Func == nil {
 			continue
 		}
-		mainGraph.AddNode(graphName, strconv.Itoa(n.ID), map[string]string{
-			"label": "\"" + util.Escape(util.GetFuncSimpleName(n.Func.Name, f.pkgPrefix)) + "\"",
+		mainGraph.AddNode(graphName, strconv.Itoa(f.getRenderID(n, foldedIDs)), map[string]string{
+			"label": "\"" + util.Escape(f.getNodeLabel(n)) + "\"",
 		})
 	}
+	addedEdges := make(map[string]bool)
 	for _, e := range edges {
 		if e.Callee == nil || e.Caller == nil {
 			continue
 		}
-		callerID := strconv.Itoa(e.Caller.ID)
-		calleeID := strconv.Itoa(e.Callee.ID)
-		mainGraph.AddEdge(callerID, calleeID, true, map[string]string{
-			"label": "\"" + util.Escape(util.GetSiteSimpleName(e.Site.Name, f.pkgPrefix)) + "\"",
+		callerID := strconv.Itoa(f.getRenderID(e.Caller, foldedIDs))
+		calleeID := strconv.Itoa(f.getRenderID(e.Callee, foldedIDs))
+		edgeKey := fmt.Sprintf("%s->%s:%s", callerID, calleeID, f.getEdgeLabel(e))
+		if addedEdges[edgeKey] {
+			continue
+		}
+		addedEdges[edgeKey] = true
+		attrs := map[string]string{
+			"label": "\"" + util.Escape(f.getEdgeLabel(e)) + "\"",
 			//"constraint": "false",
-		})
+		}
+		if skipEdges[e.String()] {
+			attrs["style"] = "dashed"
+			attrs["color"] = "blue"
+		}
+		mainGraph.AddEdge(callerID, calleeID, true, attrs)
 	}
 	for i, l := range f.Layers {
 		layerInSet := make(map[*ir.Node]bool)
@@ -366,9 +500,9 @@ func (f *Flow) GetDot(isSimple bool) string {
 			subGraphName := fmt.Sprintf("\"cluster_%d-in\"", i)
 			mainGraph.AddSubGraph(graphName, subGraphName, attr)
 			for n, _ := range layerInSet {
-				nodeID := strconv.Itoa(n.ID)
+				nodeID := strconv.Itoa(f.getRenderID(n, foldedIDs))
 				mainGraph.AddNode(subGraphName, nodeID, map[string]string{
-					"label": "\"" + util.Escape(util.GetFuncSimpleName(n.Func.Name, f.pkgPrefix)) + "\"",
+					"label": "\"" + util.Escape(f.getNodeLabel(n)) + "\"",
 					"color": "green",
 				})
 			}
@@ -377,9 +511,9 @@ func (f *Flow) GetDot(isSimple bool) string {
 			subGraphName := fmt.Sprintf("cluster_%d", i)
 			mainGraph.AddSubGraph(graphName, subGraphName, attr)
 			for n, _ := range layerNodeSet {
-				nodeID := strconv.Itoa(n.ID)
+				nodeID := strconv.Itoa(f.getRenderID(n, foldedIDs))
 				mainGraph.AddNode(subGraphName, nodeID, map[string]string{
-					"label": "\"" + util.Escape(util.GetFuncSimpleName(n.Func.Name, f.pkgPrefix)) + "\"",
+					"label": "\"" + util.Escape(f.getNodeLabel(n)) + "\"",
 					"color": "red",
 				})
 			}
@@ -388,9 +522,9 @@ func (f *Flow) GetDot(isSimple bool) string {
 			subGraphName := fmt.Sprintf("\"cluster_%d-out\"", i)
 			mainGraph.AddSubGraph(graphName, subGraphName, attr)
 			for n, _ := range layerOutSet {
-				nodeID := strconv.Itoa(n.ID)
+				nodeID := strconv.Itoa(f.getRenderID(n, foldedIDs))
 				mainGraph.AddNode(subGraphName, nodeID, map[string]string{
-					"label": "\"" + util.Escape(util.GetFuncSimpleName(n.Func.Name, f.pkgPrefix)) + "\"",
+					"label": "\"" + util.Escape(f.getNodeLabel(n)) + "\"",
 					"color": "yellow",
 				})
 			}
@@ -399,18 +533,270 @@ func (f *Flow) GetDot(isSimple bool) string {
 	return mainGraph.String()
 }
 
+// getSkipEdges returns the edges of the example paths which are only on the paths skipping
+// layers, to be highlighted.
+func (f *Flow) getSkipEdges() map[string]bool {
+	skipEdges := make(map[string]bool)
+	for _, p := range f.Pairs {
+		for k, _ := range p.ExamplePath {
+			for _, path := range p.ExamplePath[k] {
+				for _, e := range path {
+					if isSkip, ok := skipEdges[e.String()]; !ok || isSkip {
+						skipEdges[e.String()] = p.IsSkip()
+					}
+				}
+			}
+		}
+	}
+	return skipEdges
+}
+
+func (f *Flow) getNodeLabel(n *ir.Node) string {
+	name := n.Func.Name
+	if f.foldGenerics {
+		name = n.Func.GetOriginName()
+	}
+	return util.GetFuncSimpleName(name, f.pkgPrefix) + ir.GetConfigsLabel(n.Func.Configs, f.callgraph.Configs)
+}
+
+// SetFoldGenerics sets whether all instantiations of a generic function are rendered as one node.
+func (f *Flow) SetFoldGenerics(foldGenerics bool) {
+	f.foldGenerics = foldGenerics
+}
+
+// getFoldedIDs maps the generic origins to the smallest ID of their instantiations,
+// which is used as the ID of the folded node.
+func (f *Flow) getFoldedIDs() map[string]int {
+	foldedIDs := make(map[string]int)
+	if !f.foldGenerics {
+		return foldedIDs
+	}
+	for _, n := range f.callgraph.Nodes {
+		if n.Func == nil || n.Func.Origin == nil {
+			continue
+		}
+		if id, ok := foldedIDs[n.Func.Origin.Name]; !ok || n.ID < id {
+			foldedIDs[n.Func.Origin.Name] = n.ID
+		}
+	}
+	return foldedIDs
+}
+
+func (f *Flow) getRenderID(n *ir.Node, foldedIDs map[string]int) int {
+	if n.Func != nil && n.Func.Origin != nil {
+		if id, ok := foldedIDs[n.Func.Origin.Name]; ok {
+			return id
+		}
+	}
+	return n.ID
+}
+
+func (f *Flow) foldRenderGraph(nodeSet []*render.Node, edgeSet []*render.Edge) ([]*render.Node, []*render.Edge) {
+	foldedIDs := f.getFoldedIDs()
+	nodesByID := make(map[int]*ir.Node)
+	for _, n := range f.callgraph.Nodes {
+		nodesByID[n.ID] = n
+	}
+	getRenderID := func(id int) int {
+		if n, ok := nodesByID[id]; ok {
+			return f.getRenderID(n, foldedIDs)
+		}
+		return id
+	}
+	foldedNodes := make(map[int]*render.Node)
+	for _, n := range nodeSet {
+		id := getRenderID(n.ID)
+		if existing, ok := foldedNodes[id]; ok && (existing.Set >= 0 || n.Set < 0) {
+			continue
+		}
+		if irNode, ok := nodesByID[n.ID]; ok && irNode.Func.Origin != nil {
+			n.ID = id
+			n.Name = f.getNodeLabel(irNode)
+			n.Detail = irNode.Func.Origin.Name
+		}
+		foldedNodes[id] = n
+	}
+	foldedEdges := make(map[string]*render.Edge)
+	for _, e := range edgeSet {
+		e.From = getRenderID(e.From)
+		e.To = getRenderID(e.To)
+		foldedEdges[fmt.Sprintf("%d->%d:%s", e.From, e.To, e.Name)] = e
+	}
+	nodeSet = make([]*render.Node, 0, len(foldedNodes))
+	for _, n := range foldedNodes {
+		nodeSet = append(nodeSet, n)
+	}
+	edgeSet = make([]*render.Edge, 0, len(foldedEdges))
+	for _, e := range foldedEdges {
+		edgeSet = append(edgeSet, e)
+	}
+	return nodeSet, edgeSet
+}
+
+func (f *Flow) getEdgeLabel(e *ir.Edge) string {
+	return util.GetSiteSimpleName(e.Site.Name, f.pkgPrefix) + ir.GetConfigsLabel(e.Site.Configs, f.callgraph.Configs)
+}
+
 func (f *Flow) SaveDot(filename string, isSimple bool) error {
 	dotString := f.GetDot(isSimple)
 	return util.WriteToFile(dotString, filename)
 }
 
 type Layer struct {
-	Name        string
-	Entities    []*Entity
-	NodeSet     map[*ir.Node]bool
+	Name     string
+	Entities []*Entity
+	NodeSet  map[*ir.Node]bool
+}
+
+// LayerPair connects the out nodes of a layer to the in nodes of a later one by example paths.
+// Pairs skipping optional layers only connect them by the paths avoiding the nodes of the skipped
+// layers, so a flow through a layer is never reported as skipping it.
+type LayerPair struct {
+	From    int
+	To      int
+	Skipped []int
+	// Via are the waypoints the paths pass in order, Avoid the funcs they do not pass
+	Via         []*mode.Mode
+	Avoid       *mode.Mode
 	ExamplePath map[*ir.Node]map[*ir.Node][]*ir.Edge
 }
 
+func (p *LayerPair) IsSkip() bool {
+	return len(p.Skipped) > 0
+}
+
+// getLayerPairs returns the pairs of every layer with its successors and, skipping the optional
+// layers, their successors, ordered by their layers. A pair of layers connected directly does not
+// skip layers, even if they are connected by skipping too. The layers reached by skipping are
+// searched once per layer, so the paths through diamonds of optional layers are not walked one
+// by one.
+func getLayerPairs(config *config.Config, successors [][]int) []*LayerPair {
+	skippable := func(i int) bool {
+		return config.AllowSkip || config.Layers[i].Optional
+	}
+	reaches := make([]map[int]bool, len(config.Layers))
+	for i, _ := range config.Layers {
+		reaches[i] = getSkipReach(successors, i, skippable)
+	}
+	pairs := make([]*LayerPair, 0)
+	for i, _ := range config.Layers {
+		direct := make(map[int]bool)
+		for _, j := range successors[i] {
+			direct[j] = true
+		}
+		for j, _ := range reaches[i] {
+			if j == i {
+				continue
+			}
+			p := &LayerPair{From: i, To: j}
+			if !direct[j] {
+				// the skipped layers are the ones on a path from i to j
+				for k, _ := range reaches[i] {
+					if k != i && k != j && skippable(k) && reaches[k][j] {
+						p.Skipped = append(p.Skipped, k)
+					}
+				}
+				sort.Ints(p.Skipped)
+			}
+			pairs = append(pairs, p)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].From != pairs[j].From {
+			return pairs[i].From < pairs[j].From
+		}
+		return pairs[i].To < pairs[j].To
+	})
+	return pairs
+}
+
+// getSkipReach returns the layers the layer flows to, directly or through skippable layers.
+func getSkipReach(successors [][]int, from int, skippable func(int) bool) map[int]bool {
+	reach := make(map[int]bool)
+	queue := append([]int{}, successors[from]...)
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		if reach[i] {
+			continue
+		}
+		reach[i] = true
+		if skippable(i) {
+			queue = append(queue, successors[i]...)
+		}
+	}
+	return reach
+}
+
+// setPairWaypoints sets the via and avoid of the pairs of config to the layer pairs.
+func setPairWaypoints(config *config.Config, pairs []*LayerPair) error {
+	for i, cp := range config.Pairs {
+		from, to, err := config.GetPairLayers(cp)
+		if err != nil {
+			return fmt.Errorf("pair %d: %w", i, err)
+		}
+		found := false
+		for _, p := range pairs {
+			if p.From == from && p.To == to {
+				p.Via, p.Avoid = cp.Via, cp.Avoid
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("pair %d: layer %q does not flow to layer %q", i, cp.From, cp.To)
+		}
+	}
+	return nil
+}
+
+// getLayerDepths returns the length of the longest chain of next layers to every layer.
+func (f *Flow) getLayerDepths() []int {
+	depths := make([]int, len(f.Layers))
+	for _, i := range f.order {
+		for _, p := range f.getOutPairs(i) {
+			if !p.IsSkip() && depths[i]+1 > depths[p.To] {
+				depths[p.To] = depths[i] + 1
+			}
+		}
+	}
+	return depths
+}
+
+// getInPairs returns the pairs to the layer.
+func (f *Flow) getInPairs(layer int) []*LayerPair {
+	pairs := make([]*LayerPair, 0)
+	for _, p := range f.Pairs {
+		if p.To == layer {
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs
+}
+
+// getOutPairs returns the pairs from the layer.
+func (f *Flow) getOutPairs(layer int) []*LayerPair {
+	pairs := make([]*LayerPair, 0)
+	for _, p := range f.Pairs {
+		if p.From == layer {
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs
+}
+
+// getPairStarts returns the start nodes of the example paths from the layer.
+func (f *Flow) getPairStarts(layer int) map[*ir.Node]bool {
+	starts := make(map[*ir.Node]bool)
+	for _, p := range f.getOutPairs(layer) {
+		pairStarts, _ := GetStartAndEndFromExamplePath(p.ExamplePath)
+		for k, _ := range pairStarts {
+			starts[k] = true
+		}
+	}
+	return starts
+}
+
 func (l *Layer) GetInToOutEdgeSet(callgraphIR *ir.Callgraph) map[*ir.Node]map[*ir.Node][][]*ir.Edge {
 	inToOutSet := make(map[*ir.Node]map[*ir.Node][][]*ir.Edge)
 	for _, e := range l.Entities {
@@ -429,41 +815,11 @@ func (l *Layer) GetInToOutEdgeSet(callgraphIR *ir.Callgraph) map[*ir.Node]map[*i
 
 func (l *Layer) ResetLayer() {
 	l.NodeSet = nil
-	l.ExamplePath = nil
 	for _, e := range l.Entities {
 		e.ResetEntity()
 	}
 }
 
-func (l *Layer) GetExamplePath(callgraphIR *ir.Callgraph) map[*ir.Node]map[*ir.Node][]*ir.Edge {
-	if callgraphIR == nil {
-		return nil
-	}
-	if l.ExamplePath != nil {
-		return l.ExamplePath
-	}
-	examplePath := make(map[*ir.Node]map[*ir.Node][]*ir.Edge)
-	for _, v := range l.Entities {
-		for k, _ := range v.ExamplePath {
-			if _, ok := examplePath[k]; !ok {
-				examplePath[k] = make(map[*ir.Node][]*ir.Edge)
-			}
-			for k2, _ := range v.ExamplePath[k] {
-				examplePath[k][k2] = v.ExamplePath[k][k2]
-			}
-		}
-	}
-	l.ExamplePath = examplePath
-	return examplePath
-}
-
-func (l *Layer) GetStartAndEndFromExamplePath() (startNodeSet, endNodeSet map[*ir.Node]bool) {
-	if l.ExamplePath == nil {
-		return
-	}
-	return GetStartAndEndFromExamplePath(l.ExamplePath)
-}
-
 func GetStartAndEndFromExamplePath(examplePath map[*ir.Node]map[*ir.Node][]*ir.Edge) (startNodeSet, endNodeSet map[*ir.Node]bool) {
 	if examplePath == nil {
 		return
@@ -884,7 +1240,7 @@ func matchesEntityIR(n *ir.Node, entity *Entity) bool {
 	if n == nil || n.Func == nil || n.Func.Name == "" || n.Func.Signature == "" {
 		return false
 	}
-	if entity == nil || (entity.Name == nil && entity.InSite == nil && entity.OutSite == nil) {
+	if entity == nil || (entity.Name == nil && entity.Origin == nil && entity.InSite == nil && entity.OutSite == nil) {
 		return false
 	}
 	fName := n.Func.Name
@@ -895,6 +1251,10 @@ func matchesEntityIR(n *ir.Node, entity *Entity) bool {
 			nameCheckPass = true
 		}
 	}
+	originCheckPass := true
+	if entity.Origin != nil {
+		originCheckPass = entity.Origin.Match(n.Func.GetOriginName())
+	}
 	inSiteCheckPass := true
 	if entity.InSite != nil {
 		inSiteCheckPass = false
@@ -924,7 +1284,7 @@ func matchesEntityIR(n *ir.Node, entity *Entity) bool {
 			signatureCheckPass = true
 		}
 	}
-	if nameCheckPass && inSiteCheckPass && outSiteCheckPass && signatureCheckPass {
+	if nameCheckPass && originCheckPass && inSiteCheckPass && outSiteCheckPass && signatureCheckPass {
 		return true
 	}
 	return false
@@ -950,5 +1310,9 @@ func getSimpleEdgeForPath(path []*ir.Edge) *ir.Edge {
 	caller := path[0].Caller
 	callee := path[len(path)-1].Callee
 	site := fmt.Sprintf("%s->...->%s", path[0].Site.Name, path[len(path)-1].Site.Name)
-	return &ir.Edge{Caller: caller, Callee: callee, Site: &ir.Site{Name: site}}
+	var configs []string
+	for _, e := range path {
+		configs = ir.IntersectConfigs(configs, e.Site.Configs)
+	}
+	return &ir.Edge{Caller: caller, Callee: callee, Site: &ir.Site{Name: site, Configs: configs}}
 }
@@ -0,0 +1,248 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"github.com/laindream/go-callflow-vis/config"
+	"github.com/laindream/go-callflow-vis/ir"
+	"github.com/laindream/go-callflow-vis/mode"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testPkgPrefix = "example.com/demo/"
+
+// testLayer is a layer matching the funcs of its package.
+type testLayer struct {
+	pkg      string
+	optional bool
+	next     []string
+}
+
+func newTestConfig(allowSkip bool, layers ...testLayer) *config.Config {
+	c := &config.Config{PackagePrefix: testPkgPrefix, AllowSkip: allowSkip}
+	for _, l := range layers {
+		c.Layers = append(c.Layers, &config.Layer{
+			Name:     l.pkg,
+			Optional: l.optional,
+			Next:     l.next,
+			Entities: []*config.Entity{{Name: &mode.Mode{Rules: []mode.Rule{
+				{Type: mode.MatchTypePrefix, Content: testPkgPrefix + l.pkg + "."},
+			}}}},
+		})
+	}
+	return c
+}
+
+// newTestCallgraph returns the callgraph of the calls, e.g. "api.Handle svc.Serve", by the names
+// of the funcs without the package prefix.
+func newTestCallgraph(calls ...string) *ir.Callgraph {
+	c := &ir.Callgraph{Nodes: make(map[string]*ir.Node)}
+	for _, call := range calls {
+		names := strings.Fields(call)
+		for _, name := range names {
+			if _, ok := c.Nodes[name]; !ok {
+				c.AddNode(&ir.Func{Name: testPkgPrefix + name, Addr: name, Signature: "func()"})
+			}
+		}
+		c.AddEdge(names[0], names[1], &ir.Site{Name: names[1] + "()", Addr: call})
+	}
+	return c
+}
+
+// getTestPaths returns the example paths of the pairs by "from-to", each as the funcs it passes,
+// e.g. "api.Handle svc.Serve".
+func getTestPaths(f *Flow) map[string][]string {
+	paths := make(map[string][]string)
+	for _, p := range f.Pairs {
+		key := fmt.Sprintf("%d-%d", p.From, p.To)
+		paths[key] = make([]string, 0)
+		for start, _ := range p.ExamplePath {
+			for _, path := range p.ExamplePath[start] {
+				names := []string{start.Func.Addr}
+				for _, e := range path {
+					names = append(names, e.Callee.Func.Addr)
+				}
+				paths[key] = append(paths[key], strings.Join(names, " "))
+			}
+		}
+		sort.Strings(paths[key])
+	}
+	return paths
+}
+
+func TestGetLayerPairs(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowSkip bool
+		layers    []testLayer
+		// want are the pairs by "from-to", with the skipped layers if any
+		want []string
+	}{
+		{
+			name:   "chain",
+			layers: []testLayer{{pkg: "a"}, {pkg: "b"}, {pkg: "c"}},
+			want:   []string{"0-1", "1-2"},
+		},
+		{
+			name:   "optional layer",
+			layers: []testLayer{{pkg: "a"}, {pkg: "b", optional: true}, {pkg: "c"}},
+			want:   []string{"0-1", "0-2 skip [1]", "1-2"},
+		},
+		{
+			name:   "consecutive optional layers",
+			layers: []testLayer{{pkg: "a"}, {pkg: "b", optional: true}, {pkg: "c", optional: true}, {pkg: "d"}},
+			want:   []string{"0-1", "0-2 skip [1]", "0-3 skip [1 2]", "1-2", "1-3 skip [2]", "2-3"},
+		},
+		{
+			name:      "allow skip",
+			allowSkip: true,
+			layers:    []testLayer{{pkg: "a"}, {pkg: "b"}, {pkg: "c"}, {pkg: "d"}},
+			want:      []string{"0-1", "0-2 skip [1]", "0-3 skip [1 2]", "1-2", "1-3 skip [2]", "2-3"},
+		},
+		{
+			name: "dag by next",
+			layers: []testLayer{
+				{pkg: "api", next: []string{"svc"}},
+				{pkg: "svc", next: []string{"dao", "cache"}},
+				{pkg: "dao"},
+				{pkg: "cache"},
+			},
+			want: []string{"0-1", "1-2", "1-3"},
+		},
+		{
+			name: "diamond of optional layers",
+			layers: []testLayer{
+				{pkg: "api", next: []string{"auth", "svc"}},
+				{pkg: "auth", optional: true, next: []string{"svc", "dao"}},
+				{pkg: "svc", optional: true, next: []string{"dao"}},
+				{pkg: "dao"},
+			},
+			want: []string{"0-1", "0-2", "0-3 skip [1 2]", "1-2", "1-3", "2-3"},
+		},
+		{
+			name: "direct pair does not skip",
+			layers: []testLayer{
+				{pkg: "api", next: []string{"svc", "dao"}},
+				{pkg: "svc", optional: true, next: []string{"dao"}},
+				{pkg: "dao"},
+			},
+			want: []string{"0-1", "0-2", "1-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(tt.allowSkip, tt.layers...)
+			successors, err := c.GetSuccessors()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			for _, p := range getLayerPairs(c, successors) {
+				s := fmt.Sprintf("%d-%d", p.From, p.To)
+				if p.IsSkip() {
+					s += fmt.Sprintf(" skip %v", p.Skipped)
+				}
+				got = append(got, s)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlowPaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowSkip bool
+		layers    []testLayer
+		calls     []string
+		// want are the example paths of the pairs by "from-to"
+		want map[string][]string
+	}{
+		{
+			name:   "chain",
+			layers: []testLayer{{pkg: "api"}, {pkg: "svc"}, {pkg: "dao"}},
+			calls:  []string{"api.Handle svc.Serve", "svc.Serve dao.Query", "api.Handle dao.Count"},
+			want: map[string][]string{
+				"0-1": {"api.Handle svc.Serve"},
+				"1-2": {"svc.Serve dao.Query"},
+			},
+		},
+		{
+			// dao.Query is reached by the regular pair through svc.Serve and by the skip pair
+			// through util.Wrap, the skip pair does not pass svc.Serve
+			name:   "skip and regular pair reaching the same node",
+			layers: []testLayer{{pkg: "api"}, {pkg: "svc", optional: true}, {pkg: "dao"}},
+			calls: []string{
+				"api.Handle svc.Serve", "svc.Serve dao.Query", "api.Handle dao.Count",
+				"api.Admin util.Wrap", "util.Wrap dao.Query",
+			},
+			want: map[string][]string{
+				"0-1": {"api.Handle svc.Serve"},
+				"0-2": {"api.Admin util.Wrap dao.Query", "api.Handle dao.Count"},
+				"1-2": {"svc.Serve dao.Query"},
+			},
+		},
+		{
+			name:   "skip pair without paths avoiding the skipped layer",
+			layers: []testLayer{{pkg: "api"}, {pkg: "svc", optional: true}, {pkg: "dao"}},
+			calls:  []string{"api.Handle svc.Serve", "svc.Serve dao.Query"},
+			want: map[string][]string{
+				"0-1": {"api.Handle svc.Serve"},
+				"0-2": {},
+				"1-2": {"svc.Serve dao.Query"},
+			},
+		},
+		{
+			name:      "allow skip",
+			allowSkip: true,
+			layers:    []testLayer{{pkg: "api"}, {pkg: "svc"}, {pkg: "dao"}},
+			calls:     []string{"api.Handle svc.Serve", "svc.Serve dao.Query", "api.Handle dao.Count"},
+			want: map[string][]string{
+				"0-1": {"api.Handle svc.Serve"},
+				"0-2": {"api.Handle dao.Count"},
+				"1-2": {"svc.Serve dao.Query"},
+			},
+		},
+		{
+			name: "dag by next",
+			layers: []testLayer{
+				{pkg: "api", next: []string{"svc"}},
+				{pkg: "svc", next: []string{"dao", "cache"}},
+				{pkg: "dao"},
+				{pkg: "cache"},
+			},
+			calls: []string{
+				"api.Handle svc.Serve", "svc.Serve dao.Query", "svc.Serve cache.Get",
+				"svc.Load cache.Get",
+			},
+			want: map[string][]string{
+				"0-1": {"api.Handle svc.Serve"},
+				"1-2": {"svc.Serve dao.Query"},
+				"1-3": {"svc.Serve cache.Get"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(tt.allowSkip, tt.layers...)
+			if err := c.Compile(); err != nil {
+				t.Fatal(err)
+			}
+			f, err := NewFlow(context.Background(), c, newTestCallgraph(tt.calls...), false, 0, 1, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = f.Generate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := getTestPaths(f); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package flow
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"github.com/laindream/go-callflow-vis/config"
+	"github.com/laindream/go-callflow-vis/ir"
+	"io"
+)
+
+// The result of a generated flow is its callgraph in the ir stream format followed by the node
+// sets of the layers and the example paths of the layer pairs, which refer to the nodes by func address. Nil sets are
+// kept apart from empty ones, as nil sets are computed on demand, and gob omits zero values, so
+// they are marked instead of being nil pointers.
+
+type result struct {
+	IssueFuncs []string
+	Layers     []*layerResult
+	Pairs      []pathsResult
+}
+
+type layerResult struct {
+	NodeSet  nodeSetResult
+	Entities []*entityResult
+}
+
+type entityResult struct {
+	NodeSet     nodeSetResult
+	InNodeSet   nodeSetResult
+	OutNodeSet  nodeSetResult
+	ExamplePath pathsResult
+}
+
+type nodeSetResult struct {
+	Nil   bool
+	Addrs []string
+}
+
+type pathsResult struct {
+	Nil   bool
+	Paths []*pathResult
+}
+
+type pathResult struct {
+	From  string
+	To    string
+	Edges []*edgeResult
+}
+
+type edgeResult struct {
+	Caller string
+	Callee string
+	Site   *ir.Site
+}
+
+// WriteResult writes the generated flow to w, to be read by NewFlowFromResult.
+func (f *Flow) WriteResult(w io.Writer) error {
+	if !f.isCompleteGenerate {
+		return fmt.Errorf("flow is not generated")
+	}
+	if err := ir.WriteCallgraph(w, f.callgraph); err != nil {
+		return err
+	}
+	r := &result{Layers: make([]*layerResult, 0, len(f.Layers))}
+	for k, _ := range f.allIssueFuncs {
+		r.IssueFuncs = append(r.IssueFuncs, k)
+	}
+	for _, l := range f.Layers {
+		lr := &layerResult{
+			NodeSet:  getNodeSetResult(l.NodeSet),
+			Entities: make([]*entityResult, 0, len(l.Entities)),
+		}
+		for _, e := range l.Entities {
+			lr.Entities = append(lr.Entities, &entityResult{
+				NodeSet:     getNodeSetResult(e.NodeSet),
+				InNodeSet:   getNodeSetResult(e.InNodeSet),
+				OutNodeSet:  getNodeSetResult(e.OutNodeSet),
+				ExamplePath: getPathsResult(e.ExamplePath),
+			})
+		}
+		r.Layers = append(r.Layers, lr)
+	}
+	for _, p := range f.Pairs {
+		r.Pairs = append(r.Pairs, getPathsResult(p.ExamplePath))
+	}
+	return gob.NewEncoder(w).Encode(r)
+}
+
+// NewFlowFromResult creates a generated flow from a result written by WriteResult for the same
+// config.
+func NewFlowFromResult(config *config.Config, r io.Reader) (*Flow, error) {
+	reader := bufio.NewReader(r)
+	callgraph, err := ir.ReadCallgraph(reader)
+	if err != nil {
+		return nil, err
+	}
+	f, err := newFlow(config, callgraph, false, 0, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	res := &result{}
+	if err = gob.NewDecoder(reader).Decode(res); err != nil {
+		return nil, err
+	}
+	if len(res.Layers) != len(f.Layers) {
+		return nil, fmt.Errorf("result has %d layers, config has %d", len(res.Layers), len(f.Layers))
+	}
+	if len(res.Pairs) != len(f.Pairs) {
+		return nil, fmt.Errorf("result has %d layer pairs, config has %d", len(res.Pairs), len(f.Pairs))
+	}
+	f.allIssueFuncs = make(map[string]bool)
+	for _, k := range res.IssueFuncs {
+		f.allIssueFuncs[k] = true
+	}
+	for i, lr := range res.Layers {
+		l := f.Layers[i]
+		if len(lr.Entities) != len(l.Entities) {
+			return nil, fmt.Errorf("result layer %d has %d entities, config has %d", i, len(lr.Entities), len(l.Entities))
+		}
+		if l.NodeSet, err = f.getNodeSet(lr.NodeSet); err != nil {
+			return nil, err
+		}
+		for j, er := range lr.Entities {
+			e := l.Entities[j]
+			if e.NodeSet, err = f.getNodeSet(er.NodeSet); err != nil {
+				return nil, err
+			}
+			if e.InNodeSet, err = f.getNodeSet(er.InNodeSet); err != nil {
+				return nil, err
+			}
+			if e.OutNodeSet, err = f.getNodeSet(er.OutNodeSet); err != nil {
+				return nil, err
+			}
+			if e.ExamplePath, err = f.getExamplePath(er.ExamplePath); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, pr := range res.Pairs {
+		if f.Pairs[i].ExamplePath, err = f.getExamplePath(pr); err != nil {
+			return nil, err
+		}
+	}
+	f.isCompleteGenerate = true
+	return f, nil
+}
+
+func getNodeSetResult(nodeSet map[*ir.Node]bool) nodeSetResult {
+	if nodeSet == nil {
+		return nodeSetResult{Nil: true}
+	}
+	r := nodeSetResult{Addrs: make([]string, 0, len(nodeSet))}
+	for n, _ := range nodeSet {
+		r.Addrs = append(r.Addrs, getNodeAddr(n))
+	}
+	return r
+}
+
+func getPathsResult(examplePath map[*ir.Node]map[*ir.Node][]*ir.Edge) pathsResult {
+	if examplePath == nil {
+		return pathsResult{Nil: true}
+	}
+	r := pathsResult{}
+	for from, _ := range examplePath {
+		for to, edges := range examplePath[from] {
+			p := &pathResult{From: getNodeAddr(from), To: getNodeAddr(to), Edges: make([]*edgeResult, 0, len(edges))}
+			for _, e := range edges {
+				p.Edges = append(p.Edges, &edgeResult{Caller: getNodeAddr(e.Caller), Callee: getNodeAddr(e.Callee), Site: e.Site})
+			}
+			r.Paths = append(r.Paths, p)
+		}
+	}
+	return r
+}
+
+func getNodeAddr(n *ir.Node) string {
+	if n == nil || n.Func == nil {
+		return ""
+	}
+	return n.Func.Addr
+}
+
+func (f *Flow) getNode(addr string) (*ir.Node, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	n, ok := f.callgraph.Nodes[addr]
+	if !ok {
+		return nil, fmt.Errorf("result node %s is not in the callgraph", addr)
+	}
+	return n, nil
+}
+
+func (f *Flow) getNodeSet(r nodeSetResult) (map[*ir.Node]bool, error) {
+	if r.Nil {
+		return nil, nil
+	}
+	nodeSet := make(map[*ir.Node]bool, len(r.Addrs))
+	for _, addr := range r.Addrs {
+		n, err := f.getNode(addr)
+		if err != nil {
+			return nil, err
+		}
+		nodeSet[n] = true
+	}
+	return nodeSet, nil
+}
+
+func (f *Flow) getExamplePath(r pathsResult) (map[*ir.Node]map[*ir.Node][]*ir.Edge, error) {
+	if r.Nil {
+		return nil, nil
+	}
+	examplePath := make(map[*ir.Node]map[*ir.Node][]*ir.Edge)
+	for _, p := range r.Paths {
+		from, err := f.getNode(p.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := f.getNode(p.To)
+		if err != nil {
+			return nil, err
+		}
+		edges := make([]*ir.Edge, 0, len(p.Edges))
+		for _, er := range p.Edges {
+			e, err := f.getEdge(er)
+			if err != nil {
+				return nil, err
+			}
+			edges = append(edges, e)
+		}
+		if _, ok := examplePath[from]; !ok {
+			examplePath[from] = make(map[*ir.Node][]*ir.Edge)
+		}
+		examplePath[from][to] = edges
+	}
+	return examplePath, nil
+}
+
+// getEdge returns the callgraph edge of the result edge, or a new edge between its nodes if the
+// callgraph has none.
+func (f *Flow) getEdge(r *edgeResult) (*ir.Edge, error) {
+	caller, err := f.getNode(r.Caller)
+	if err != nil {
+		return nil, err
+	}
+	callee, err := f.getNode(r.Callee)
+	if err != nil {
+		return nil, err
+	}
+	e := &ir.Edge{Caller: caller, Site: r.Site, Callee: callee}
+	if caller != nil {
+		for _, out := range caller.Out {
+			if out.ID() == e.ID() {
+				return out, nil
+			}
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,73 @@
+package ir
+
+type changeKind int
+
+const (
+	// the node lost all its edges and was removed from Nodes
+	changeNodeDeleted changeKind = iota
+	// the edge at pos was swap-removed from the In or Out of node
+	changeEdgeRemoved
+	// the edge was appended to the In or Out of node
+	changeEdgeAppended
+)
+
+type change struct {
+	kind  changeKind
+	node  *Node
+	edge  *Edge
+	isIn  bool
+	pos   int
+	edges [2][]*Edge // In and Out of a deleted node
+}
+
+// StartChangeLog records the changes made by AddEdge and DeleteNode from now on, so that
+// UndoChanges can restore the callgraph without keeping a copy of it.
+func (c *Callgraph) StartChangeLog() {
+	c.logging = true
+	c.changes = nil
+}
+
+// UndoChanges reverts the logged changes in reverse order, restoring the callgraph exactly,
+// including the order of the edges. Logging goes on afterwards.
+func (c *Callgraph) UndoChanges() {
+	for i := len(c.changes) - 1; i >= 0; i-- {
+		ch := c.changes[i]
+		n := ch.node
+		switch ch.kind {
+		case changeNodeDeleted:
+			n.In, n.Out = ch.edges[0], ch.edges[1]
+			n.inIndex, n.outIndex = nil, nil
+			if n.Func != nil {
+				c.Nodes[n.Func.Addr] = n
+			}
+		case changeEdgeRemoved:
+			edges := &n.Out
+			if ch.isIn {
+				edges = &n.In
+			}
+			*edges = append(*edges, nil)
+			last := len(*edges) - 1
+			if ch.pos != last {
+				(*edges)[last] = (*edges)[ch.pos]
+			}
+			(*edges)[ch.pos] = ch.edge
+			n.inIndex, n.outIndex = nil, nil
+		case changeEdgeAppended:
+			if ch.isIn {
+				n.In[len(n.In)-1] = nil
+				n.In = n.In[:len(n.In)-1]
+			} else {
+				n.Out[len(n.Out)-1] = nil
+				n.Out = n.Out[:len(n.Out)-1]
+			}
+			n.inIndex, n.outIndex = nil, nil
+		}
+	}
+	c.changes = nil
+}
+
+func (c *Callgraph) logChange(ch *change) {
+	if c.logging {
+		c.changes = append(c.changes, ch)
+	}
+}
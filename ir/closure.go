@@ -0,0 +1,79 @@
+package ir
+
+import (
+	"fmt"
+	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/ssa"
+	"unsafe"
+)
+
+// GetNamedFunc returns the outermost named function enclosing fn, or fn itself if it is not a closure.
+func GetNamedFunc(fn *ssa.Function) *ssa.Function {
+	for fn != nil && fn.Parent() != nil {
+		fn = fn.Parent()
+	}
+	return fn
+}
+
+// getClosureFoldedNodes converts the nodes of graph with every closure replaced by its outermost
+// named parent: the calls made in a closure become calls of the parent, and the calls from the
+// parent (or sibling closures) to the closure itself are dropped, so only named functions remain.
+// The calls of a closure back into its parent are kept as self edges, like other recursion.
+func getClosureFoldedNodes(graph *callgraph.Graph) map[string]*Node {
+	nextID := 0
+	for _, node := range graph.Nodes {
+		if node.ID >= nextID {
+			nextID = node.ID + 1
+		}
+	}
+	nodes := make(map[string]*Node)
+	getNode := func(fn *ssa.Function) *Node {
+		named := GetNamedFunc(fn)
+		if n, ok := nodes[GetFuncAddr(named)]; ok {
+			return n
+		}
+		id := nextID
+		if node, ok := graph.Nodes[named]; ok && node != nil {
+			id = node.ID
+		} else {
+			nextID++
+		}
+		n := &Node{
+			Func: GetFuncIR(named),
+			ID:   id,
+		}
+		nodes[n.Func.Addr] = n
+		return n
+	}
+	for f, node := range graph.Nodes {
+		if f == nil || node.Func == nil {
+			continue
+		}
+		caller := getNode(f)
+		for _, edge := range node.Out {
+			if edge.Callee == nil || edge.Callee.Func == nil {
+				continue
+			}
+			callee := getNode(edge.Callee.Func)
+			// the calls into the own closures are dropped, recursion stays as a self edge
+			if caller == callee && edge.Callee.Func.Parent() != nil && edge.Callee.Func != f {
+				continue
+			}
+			var site *Site
+			if edge.Site != nil {
+				site = &Site{
+					Name: edge.Site.String(),
+					Addr: fmt.Sprintf("%p", unsafe.Pointer(&edge.Site)),
+				}
+			}
+			e := &Edge{
+				Caller: caller,
+				Site:   site,
+				Callee: callee,
+			}
+			callee.AddIn(e)
+			caller.AddOut(e)
+		}
+	}
+	return nodes
+}
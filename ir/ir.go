@@ -5,7 +5,7 @@ import (
 	"github.com/laindream/go-callflow-vis/render"
 	"github.com/laindream/go-callflow-vis/util"
 	"golang.org/x/tools/go/callgraph"
-	"math"
+	"golang.org/x/tools/go/ssa"
 	"strings"
 	"unsafe"
 )
@@ -13,50 +13,153 @@ import (
 type Callgraph struct {
 	Root  *Node
 	Nodes map[string]*Node
-}
-
-func (c *Callgraph) AddEdge(callerFn, calleeFn string, site *Site) {
+	// Unanalyzed maps the packages skipped because of load errors to the reason
+	Unanalyzed map[string]string
+	// Configs are the names of the build configurations merged into the callgraph
+	Configs []string
+	// ClosuresFolded is set if the calls of closures are attributed to their outermost named parent
+	ClosuresFolded bool
+	// changes are logged to be undone after StartChangeLog
+	changes []*change
+	logging bool
+	// maxID is the largest node ID, 0 until the nodes are scanned by nextID
+	maxID int
+}
+
+// AddEdge adds the edge between the funcs of the addresses and returns it, nil if either func is
+// not in the callgraph or the edge exists already.
+func (c *Callgraph) AddEdge(callerFn, calleeFn string, site *Site) *Edge {
 	caller := c.Nodes[callerFn]
 	callee := c.Nodes[calleeFn]
 	if caller == nil || callee == nil {
-		return
+		return nil
 	}
 	edge := &Edge{
 		Caller: caller,
 		Site:   site,
 		Callee: callee,
 	}
-	callee.AddIn(edge)
-	caller.AddOut(edge)
+	added := false
+	if callee.AddIn(edge) {
+		c.logChange(&change{kind: changeEdgeAppended, node: callee, isIn: true})
+		added = true
+	}
+	if caller.AddOut(edge) {
+		c.logChange(&change{kind: changeEdgeAppended, node: caller})
+		added = true
+	}
+	if !added {
+		return nil
+	}
+	return edge
 }
 
-func (c *Callgraph) ResetSearched() {
-	c.Root.ResetSearched()
-	for _, v := range c.Nodes {
-		v.ResetSearched()
+func (c *Callgraph) AddNode(fn *Func) *Node {
+	if fn == nil {
+		return nil
+	}
+	if n, ok := c.Nodes[fn.Addr]; ok {
+		return n
+	}
+	n := &Node{
+		Func: fn,
+		ID:   c.nextID(),
+	}
+	c.Nodes[fn.Addr] = n
+	return n
+}
+
+// nextID returns an ID above the IDs of all nodes. The nodes are only scanned by the first call,
+// the nodes added later take their IDs from nextID.
+func (c *Callgraph) nextID() int {
+	if c.maxID == 0 {
+		if c.Root != nil {
+			c.maxID = c.Root.ID
+		}
+		for _, v := range c.Nodes {
+			if v.ID > c.maxID {
+				c.maxID = v.ID
+			}
+		}
 	}
-	return
+	c.maxID++
+	return c.maxID
 }
 
+// DeleteNode removes the node and its edges in O(degree) by the edge indexes of its neighbors.
 func (c *Callgraph) DeleteNode(n *Node) *Callgraph {
-	inOutNumMultiplier := len(n.In) * len(n.Out)
-	inOutNumAdder := len(n.In) + len(n.Out)
-	nodeRate := len(c.Nodes) * int(math.Sqrt(float64(len(c.Nodes))))
-	if inOutNumMultiplier > nodeRate ||
-		inOutNumAdder*inOutNumAdder > nodeRate {
-		return GetFilteredCallgraph(c, func(s string) bool {
-			return s != n.Func.Name
-		})
-	}
-	n.DeleteIns()
-	n.DeleteOuts()
+	in, out := n.In, n.Out
+	n.In, n.Out = nil, nil
+	n.inIndex, n.outIndex = nil, nil
 	if n.Func != nil {
 		delete(c.Nodes, n.Func.Addr)
 	}
+	c.logChange(&change{kind: changeNodeDeleted, node: n, edges: [2][]*Edge{in, out}})
+	for _, e := range in {
+		if e.Caller == nil {
+			continue
+		}
+		if pos, ok := e.Caller.removeOut(e); ok {
+			c.logChange(&change{kind: changeEdgeRemoved, node: e.Caller, edge: e, pos: pos})
+		}
+	}
+	for _, e := range out {
+		if e.Callee == nil {
+			continue
+		}
+		if pos, ok := e.Callee.removeIn(e); ok {
+			c.logChange(&change{kind: changeEdgeRemoved, node: e.Callee, edge: e, isIn: true, pos: pos})
+		}
+	}
 	return c
 }
 
-func ConvertToIR(graph *callgraph.Graph) *Callgraph {
+func GetFuncAddr(fn *ssa.Function) string {
+	return fmt.Sprintf("%p", unsafe.Pointer(fn))
+}
+
+func GetFuncIR(fn *ssa.Function) *Func {
+	if fn == nil {
+		return nil
+	}
+	var fp *Func
+	var fSig string
+	if fn.Signature != nil {
+		fSig = fn.Signature.String()
+	}
+	if fn.Parent() != nil {
+		fpSig := ""
+		if fn.Parent().Signature != nil {
+			fpSig = fn.Parent().Signature.String()
+		}
+		fp = &Func{
+			Name:      fn.Parent().String(),
+			Addr:      GetFuncAddr(fn.Parent()),
+			Signature: fpSig,
+		}
+	}
+	var fo *Func
+	if fn.Origin() != nil {
+		foSig := ""
+		if fn.Origin().Signature != nil {
+			foSig = fn.Origin().Signature.String()
+		}
+		fo = &Func{
+			Name:      fn.Origin().String(),
+			Addr:      GetFuncAddr(fn.Origin()),
+			Signature: foSig,
+		}
+	}
+	return &Func{
+		Name:      fn.String(),
+		Addr:      GetFuncAddr(fn),
+		Parent:    fp,
+		Origin:    fo,
+		Signature: fSig,
+	}
+}
+
+func ConvertToIR(graph *callgraph.Graph, foldClosures bool) *Callgraph {
 	getPointerStr := func(p unsafe.Pointer) string {
 		return fmt.Sprintf("%p", p)
 	}
@@ -93,6 +196,13 @@ func ConvertToIR(graph *callgraph.Graph) *Callgraph {
 			ID: graph.Root.ID,
 		}
 	}
+	if foldClosures {
+		return &Callgraph{
+			Root:           root,
+			Nodes:          getClosureFoldedNodes(graph),
+			ClosuresFolded: true,
+		}
+	}
 	nodes := make(map[string]*Node)
 	for f, node := range graph.Nodes {
 		if f == nil {
@@ -101,28 +211,7 @@ func ConvertToIR(graph *callgraph.Graph) *Callgraph {
 		if node.Func == nil {
 			continue
 		}
-		var fp *Func
-		var fSig string
-		if node.Func.Signature != nil {
-			fSig = node.Func.Signature.String()
-		}
-		if node.Func.Parent() != nil {
-			fpSig := ""
-			if node.Func.Parent().Signature != nil {
-				fpSig = node.Func.Parent().Signature.String()
-			}
-			fp = &Func{
-				Name:      node.Func.Parent().String(),
-				Addr:      getPointerStr(unsafe.Pointer(node.Func.Parent())),
-				Signature: fpSig,
-			}
-		}
-		funcIR := &Func{
-			Name:      node.Func.String(),
-			Addr:      getPointerStr(unsafe.Pointer(node.Func)),
-			Parent:    fp,
-			Signature: fSig,
-		}
+		funcIR := GetFuncIR(node.Func)
 		nodes[funcIR.Addr] = &Node{
 			Func: funcIR,
 			ID:   node.ID,
@@ -135,7 +224,6 @@ func ConvertToIR(graph *callgraph.Graph) *Callgraph {
 		if node.Func == nil {
 			continue
 		}
-		nodeIR := nodes[getPointerStr(unsafe.Pointer(attr))]
 		for _, edge := range node.Out {
 			caller := nodes[getPointerStr(unsafe.Pointer(edge.Caller.Func))]
 			callee := nodes[getPointerStr(unsafe.Pointer(edge.Callee.Func))]
@@ -151,7 +239,7 @@ func ConvertToIR(graph *callgraph.Graph) *Callgraph {
 				Site:   site,
 				Callee: callee,
 			}
-			nodeIR.Out = append(caller.Out, edgeIR)
+			caller.AddOut(edgeIR)
 		}
 		for _, edge := range node.In {
 			caller := nodes[getPointerStr(unsafe.Pointer(edge.Caller.Func))]
@@ -168,7 +256,7 @@ func ConvertToIR(graph *callgraph.Graph) *Callgraph {
 				Site:   site,
 				Callee: callee,
 			}
-			nodeIR.In = append(callee.In, edgeIR)
+			callee.AddIn(edgeIR)
 		}
 	}
 	return &Callgraph{
@@ -238,11 +326,21 @@ func GetFilteredCallgraph(graph *Callgraph, filter func(string) bool) *Callgraph
 				Signature: fpSig,
 			}
 		}
+		var fo *Func
+		if node.Func.Origin != nil {
+			fo = &Func{
+				Name:      node.Func.Origin.Name,
+				Addr:      node.Func.Origin.Addr,
+				Signature: node.Func.Origin.Signature,
+			}
+		}
 		funcIR := &Func{
 			Name:      node.Func.Name,
 			Addr:      node.Func.Addr,
 			Parent:    fp,
+			Origin:    fo,
 			Signature: fSig,
+			Configs:   node.Func.Configs,
 		}
 		nodes[funcIR.Addr] = &Node{
 			Func: funcIR,
@@ -259,7 +357,6 @@ func GetFilteredCallgraph(graph *Callgraph, filter func(string) bool) *Callgraph
 		if !filter(node.Func.Name) {
 			continue
 		}
-		nodeIR := nodes[attr]
 		for _, edge := range node.Out {
 			if !filter(edge.Callee.Func.Name) {
 				continue
@@ -269,8 +366,9 @@ func GetFilteredCallgraph(graph *Callgraph, filter func(string) bool) *Callgraph
 			var site *Site
 			if edge.Site != nil {
 				site = &Site{
-					Name: edge.Site.Name,
-					Addr: edge.Site.Addr,
+					Name:    edge.Site.Name,
+					Addr:    edge.Site.Addr,
+					Configs: edge.Site.Configs,
 				}
 			}
 			edgeIR := &Edge{
@@ -278,7 +376,7 @@ func GetFilteredCallgraph(graph *Callgraph, filter func(string) bool) *Callgraph
 				Site:   site,
 				Callee: callee,
 			}
-			nodeIR.Out = append(caller.Out, edgeIR)
+			caller.AddOut(edgeIR)
 		}
 		for _, edge := range node.In {
 			if !filter(edge.Caller.Func.Name) {
@@ -289,8 +387,9 @@ func GetFilteredCallgraph(graph *Callgraph, filter func(string) bool) *Callgraph
 			var site *Site
 			if edge.Site != nil {
 				site = &Site{
-					Name: edge.Site.Name,
-					Addr: edge.Site.Addr,
+					Name:    edge.Site.Name,
+					Addr:    edge.Site.Addr,
+					Configs: edge.Site.Configs,
 				}
 			}
 			edgeIR := &Edge{
@@ -298,25 +397,41 @@ func GetFilteredCallgraph(graph *Callgraph, filter func(string) bool) *Callgraph
 				Site:   site,
 				Callee: callee,
 			}
-			nodeIR.In = append(callee.In, edgeIR)
+			callee.AddIn(edgeIR)
 		}
 	}
 	return &Callgraph{
-		Root:  root,
-		Nodes: nodes,
+		Root:           root,
+		Nodes:          nodes,
+		Unanalyzed:     graph.Unanalyzed,
+		Configs:        graph.Configs,
+		ClosuresFolded: graph.ClosuresFolded,
 	}
 }
 
 type Func struct {
-	Name      string
-	Addr      string
-	Parent    *Func
+	Name   string
+	Addr   string
+	Parent *Func
+	// Origin is the generic function if the function is an instantiation of it
+	Origin    *Func
 	Signature string
+	// Configs are the build configurations the function exists in, empty if not built by a matrix
+	Configs []string
+}
+
+func (f *Func) GetOriginName() string {
+	if f.Origin != nil {
+		return f.Origin.Name
+	}
+	return f.Name
 }
 
 type Site struct {
 	Name string
 	Addr string
+	// Configs are the build configurations the call site exists in, empty if not built by a matrix
+	Configs []string
 }
 
 type Node struct {
@@ -326,19 +441,18 @@ type Node struct {
 	Out                 []*Edge
 	humanReadableInMap  map[string]*Edge
 	humanReadableOutMap map[string]*Edge
-	inMap               map[string]*Edge
-	outMap              map[string]*Edge
-	searched            bool
-	path                []*Edge
+	inIndex             map[string]int // edge id -> position in In
+	outIndex            map[string]int // edge id -> position in Out
 	tags                map[string]bool
 }
 
-func (n *Node) ToRenderNode(prefix string) *render.Node {
+func (n *Node) ToRenderNode(prefix string, allConfigs []string) *render.Node {
+	configsLabel := GetConfigsLabel(n.Func.Configs, allConfigs)
 	return &render.Node{
 		ID:     n.ID,
 		Set:    -1,
-		Name:   util.GetFuncSimpleName(n.Func.Name, prefix),
-		Detail: n.Func.Name,
+		Name:   util.GetFuncSimpleName(n.Func.Name, prefix) + configsLabel,
+		Detail: n.Func.Name + configsLabel,
 	}
 }
 
@@ -372,36 +486,75 @@ func (n *Node) UpdateHumanReadableMap() {
 }
 
 func (n *Node) UpdateInOutMap() {
-	n.inMap = make(map[string]*Edge)
-	for i, _ := range n.In {
-		n.inMap[n.In[i].String()] = n.In[i]
+	n.inIndex = getEdgeIndex(n.In)
+	n.outIndex = getEdgeIndex(n.Out)
+}
+
+func getEdgeIndex(edges []*Edge) map[string]int {
+	index := make(map[string]int, len(edges))
+	for i, _ := range edges {
+		index[edges[i].ID()] = i
 	}
-	n.outMap = make(map[string]*Edge)
-	for i, _ := range n.Out {
-		n.outMap[n.Out[i].String()] = n.Out[i]
+	return index
+}
+
+// getEdgePos returns the position of the edge id in edges. The index is built on first use, e.g.
+// after deserializing, and kept correct by AddIn, AddOut and the removals from then on, which
+// also keep the edges free of duplicate ids. Changes restoring In or Out reset it.
+func getEdgePos(edges []*Edge, index *map[string]int, id string) (int, bool) {
+	if *index == nil {
+		*index = getEdgeIndex(edges)
 	}
+	i, ok := (*index)[id]
+	return i, ok
 }
 
-func (n *Node) AddIn(e *Edge) {
-	if len(n.inMap) == 0 {
-		n.UpdateInOutMap()
+// removeEdgeAt swaps the edge at i with the last one and shrinks edges, keeping index valid.
+func removeEdgeAt(edges []*Edge, index map[string]int, i int) []*Edge {
+	last := len(edges) - 1
+	delete(index, edges[i].ID())
+	if i != last {
+		edges[i] = edges[last]
+		index[edges[i].ID()] = i
 	}
-	if _, ok := n.inMap[e.String()]; ok {
-		return
+	edges[last] = nil
+	return edges[:last]
+}
+
+// AddIn appends the edge to In unless an edge with the same id exists, returning if it did.
+func (n *Node) AddIn(e *Edge) bool {
+	if _, ok := getEdgePos(n.In, &n.inIndex, e.ID()); ok {
+		return false
 	}
-	n.inMap[e.String()] = e
+	n.inIndex[e.ID()] = len(n.In)
 	n.In = append(n.In, e)
+	return true
 }
 
-func (n *Node) AddOut(e *Edge) {
-	if len(n.outMap) == 0 {
-		n.UpdateInOutMap()
-	}
-	if _, ok := n.outMap[e.String()]; ok {
-		return
+// AddOut appends the edge to Out unless an edge with the same id exists, returning if it did.
+func (n *Node) AddOut(e *Edge) bool {
+	if _, ok := getEdgePos(n.Out, &n.outIndex, e.ID()); ok {
+		return false
 	}
-	n.outMap[e.String()] = e
+	n.outIndex[e.ID()] = len(n.Out)
 	n.Out = append(n.Out, e)
+	return true
+}
+
+func (n *Node) removeIn(e *Edge) (int, bool) {
+	i, ok := getEdgePos(n.In, &n.inIndex, e.ID())
+	if ok {
+		n.In = removeEdgeAt(n.In, n.inIndex, i)
+	}
+	return i, ok
+}
+
+func (n *Node) removeOut(e *Edge) (int, bool) {
+	i, ok := getEdgePos(n.Out, &n.outIndex, e.ID())
+	if ok {
+		n.Out = removeEdgeAt(n.Out, n.outIndex, i)
+	}
+	return i, ok
 }
 
 func (n *Node) AddEnhancementIn(e *Edge) {
@@ -412,7 +565,7 @@ func (n *Node) AddEnhancementIn(e *Edge) {
 		return
 	}
 	n.humanReadableInMap[e.ReadableString()] = e
-	n.In = append(n.In, e)
+	n.AddIn(e)
 }
 
 func (n *Node) AddEnhancementOut(e *Edge) {
@@ -423,69 +576,27 @@ func (n *Node) AddEnhancementOut(e *Edge) {
 		return
 	}
 	n.humanReadableOutMap[e.ReadableString()] = e
-	n.Out = append(n.Out, e)
-}
-
-func (n *Node) SetPath(path []*Edge) {
-	n.path = path
-}
-
-func (n *Node) GetPath() []*Edge {
-	return n.path
-}
-
-func (n *Node) ClearPath() {
-	n.path = nil
-}
-
-func (n *Node) IsSearched() bool {
-	return n.searched
-}
-
-func (n *Node) SetSearched() {
-	n.searched = true
-}
-
-func (n *Node) ResetSearched() {
-	n.searched = false
+	n.AddOut(e)
 }
 
 func (n *Node) DeleteIns() {
-	for _, e := range n.In {
-		removeOutEdge(e)
-	}
+	in := n.In
 	n.In = nil
-}
-
-func removeOutEdge(edge *Edge) {
-	caller := edge.Caller
-	n := len(caller.Out)
-	for i, e := range caller.Out {
-		if e.String() == edge.String() {
-			caller.Out[i] = caller.Out[n-1]
-			caller.Out[n-1] = nil
-			caller.Out = caller.Out[:n-1]
-			return
+	n.inIndex = nil
+	for _, e := range in {
+		if e.Caller != nil {
+			e.Caller.removeOut(e)
 		}
 	}
 }
 
 func (n *Node) DeleteOuts() {
-	for _, e := range n.Out {
-		removeInEdge(e)
-	}
+	out := n.Out
 	n.Out = nil
-}
-
-func removeInEdge(edge *Edge) {
-	caller := edge.Callee
-	n := len(caller.In)
-	for i, e := range caller.In {
-		if e.String() == edge.String() {
-			caller.In[i] = caller.In[n-1]
-			caller.In[n-1] = nil
-			caller.In = caller.In[:n-1]
-			return
+	n.outIndex = nil
+	for _, e := range out {
+		if e.Callee != nil {
+			e.Callee.removeIn(e)
 		}
 	}
 }
@@ -494,14 +605,28 @@ type Edge struct {
 	Caller *Node
 	Site   *Site
 	Callee *Node
+	id     string
+}
+
+// ID identifies the edge by the addresses of its caller, site and callee. It is computed once,
+// edges are not changed after being added.
+func (e *Edge) ID() string {
+	if e == nil {
+		return ""
+	}
+	if e.id == "" {
+		e.id = e.String()
+	}
+	return e.id
 }
 
-func (e *Edge) ToRenderEdge(prefix string) *render.Edge {
+func (e *Edge) ToRenderEdge(prefix string, allConfigs []string) *render.Edge {
+	configsLabel := GetConfigsLabel(e.Site.Configs, allConfigs)
 	return &render.Edge{
 		From:   e.Caller.ID,
 		To:     e.Callee.ID,
-		Name:   util.GetSiteSimpleName(e.Site.Name, prefix),
-		Detail: e.Site.Name,
+		Name:   util.GetSiteSimpleName(e.Site.Name, prefix) + configsLabel,
+		Detail: e.Site.Name + configsLabel,
 	}
 }
 
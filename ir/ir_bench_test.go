@@ -0,0 +1,181 @@
+package ir
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+const (
+	benchNodes   = 100000
+	benchOutDeg  = 8
+	benchHubs    = 64
+	benchNewSite = "new"
+)
+
+// newBenchGraph builds a callgraph of benchNodes nodes, each calling benchOutDeg random nodes and
+// one of benchHubs hubs, which are called by about benchNodes/benchHubs nodes each.
+func newBenchGraph() *Callgraph {
+	r := rand.New(rand.NewSource(1))
+	c := &Callgraph{Nodes: make(map[string]*Node, benchNodes)}
+	for i := 0; i < benchNodes; i++ {
+		c.AddNode(&Func{Name: fmt.Sprintf("pkg.F%d", i), Addr: getBenchAddr(i)})
+	}
+	for i := 0; i < benchNodes; i++ {
+		for j := 0; j < benchOutDeg; j++ {
+			c.AddEdge(getBenchAddr(i), getBenchAddr(r.Intn(benchNodes)), getBenchSite(i, j))
+		}
+		c.AddEdge(getBenchAddr(i), getBenchAddr(i%benchHubs), getBenchSite(i, benchOutDeg))
+	}
+	return c
+}
+
+func getBenchAddr(i int) string {
+	return fmt.Sprintf("0x%x", i)
+}
+
+func getBenchSite(i, j int) *Site {
+	return &Site{Name: fmt.Sprintf("call%d", j), Addr: fmt.Sprintf("s%d_%d", i, j)}
+}
+
+// The linear variants are the adjacency operations before the edge index: duplicates are found
+// and edges removed by comparing the String of every edge, and node IDs by scanning all nodes.
+
+func addEdgeLinear(c *Callgraph, callerFn, calleeFn string, site *Site) {
+	caller, callee := c.Nodes[callerFn], c.Nodes[calleeFn]
+	edge := &Edge{Caller: caller, Site: site, Callee: callee}
+	for _, e := range callee.In {
+		if e.String() == edge.String() {
+			return
+		}
+	}
+	callee.In = append(callee.In, edge)
+	caller.Out = append(caller.Out, edge)
+}
+
+func removeEdgeLinear(edges []*Edge, e *Edge) []*Edge {
+	for i, v := range edges {
+		if v.String() == e.String() {
+			return append(edges[:i], edges[i+1:]...)
+		}
+	}
+	return edges
+}
+
+func deleteNodeLinear(c *Callgraph, n *Node) {
+	for _, e := range n.In {
+		e.Caller.Out = removeEdgeLinear(e.Caller.Out, e)
+	}
+	for _, e := range n.Out {
+		e.Callee.In = removeEdgeLinear(e.Callee.In, e)
+	}
+	n.In, n.Out = nil, nil
+	delete(c.Nodes, n.Func.Addr)
+}
+
+func addNodeLinear(c *Callgraph, fn *Func) *Node {
+	maxID := 0
+	for _, v := range c.Nodes {
+		if v.ID > maxID {
+			maxID = v.ID
+		}
+	}
+	n := &Node{Func: fn, ID: maxID + 1}
+	c.Nodes[fn.Addr] = n
+	return n
+}
+
+func benchAddEdge(b *testing.B, add func(c *Callgraph, callerFn, calleeFn string, site *Site)) {
+	c := newBenchGraph()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		add(c, getBenchAddr(benchHubs+i%(benchNodes-benchHubs)), getBenchAddr(i%benchHubs),
+			&Site{Name: benchNewSite, Addr: fmt.Sprintf("n%d", i)})
+	}
+}
+
+func BenchmarkAddEdge(b *testing.B) {
+	benchAddEdge(b, func(c *Callgraph, callerFn, calleeFn string, site *Site) {
+		c.AddEdge(callerFn, calleeFn, site)
+	})
+}
+
+func BenchmarkAddEdgeLinear(b *testing.B) {
+	benchAddEdge(b, addEdgeLinear)
+}
+
+// benchRemoveEdge removes the calls of the hubs, rebuilding the graph when they are all removed.
+func benchRemoveEdge(b *testing.B, remove func(e *Edge)) {
+	var edges []*Edge
+	for i := 0; i < b.N; i++ {
+		if len(edges) == 0 {
+			b.StopTimer()
+			c := newBenchGraph()
+			for h := 0; h < benchHubs; h++ {
+				edges = append(edges, c.Nodes[getBenchAddr(h)].In...)
+			}
+			b.StartTimer()
+		}
+		remove(edges[len(edges)-1])
+		edges = edges[:len(edges)-1]
+	}
+}
+
+func BenchmarkRemoveEdge(b *testing.B) {
+	benchRemoveEdge(b, func(e *Edge) {
+		e.Caller.removeOut(e)
+		e.Callee.removeIn(e)
+	})
+}
+
+func BenchmarkRemoveEdgeLinear(b *testing.B) {
+	benchRemoveEdge(b, func(e *Edge) {
+		e.Caller.Out = removeEdgeLinear(e.Caller.Out, e)
+		e.Callee.In = removeEdgeLinear(e.Callee.In, e)
+	})
+}
+
+// benchDeleteNode deletes the nodes from the hubs on, rebuilding the graph when they are all
+// deleted.
+func benchDeleteNode(b *testing.B, del func(c *Callgraph, n *Node)) {
+	var c *Callgraph
+	next := benchNodes
+	for i := 0; i < b.N; i++ {
+		if next == benchNodes {
+			b.StopTimer()
+			c = newBenchGraph()
+			next = 0
+			b.StartTimer()
+		}
+		del(c, c.Nodes[getBenchAddr(next)])
+		next++
+	}
+}
+
+func BenchmarkDeleteNode(b *testing.B) {
+	benchDeleteNode(b, func(c *Callgraph, n *Node) {
+		c.DeleteNode(n)
+	})
+}
+
+func BenchmarkDeleteNodeLinear(b *testing.B) {
+	benchDeleteNode(b, deleteNodeLinear)
+}
+
+func benchAddNode(b *testing.B, add func(c *Callgraph, fn *Func) *Node) {
+	c := newBenchGraph()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		add(c, &Func{Name: fmt.Sprintf("plugin.F%d", i), Addr: getBenchAddr(benchNodes + i)})
+	}
+}
+
+func BenchmarkAddNode(b *testing.B) {
+	benchAddNode(b, func(c *Callgraph, fn *Func) *Node {
+		return c.AddNode(fn)
+	})
+}
+
+func BenchmarkAddNodeLinear(b *testing.B) {
+	benchAddNode(b, addNodeLinear)
+}
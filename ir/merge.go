@@ -0,0 +1,196 @@
+package ir
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SetConfig marks all nodes and edges of the callgraph as existing in the build configuration.
+func (c *Callgraph) SetConfig(config string) {
+	c.Configs = []string{config}
+	for _, n := range c.Nodes {
+		if n.Func != nil {
+			n.Func.Configs = []string{config}
+		}
+		for _, e := range n.In {
+			setEdgeConfigs(e, []string{config})
+		}
+		for _, e := range n.Out {
+			setEdgeConfigs(e, []string{config})
+		}
+	}
+	if len(c.Unanalyzed) > 0 {
+		unanalyzed := make(map[string]string)
+		for k, v := range c.Unanalyzed {
+			unanalyzed[k] = fmt.Sprintf("[%s] %s", config, v)
+		}
+		c.Unanalyzed = unanalyzed
+	}
+}
+
+func setEdgeConfigs(e *Edge, configs []string) {
+	if e.Site == nil {
+		e.Site = &Site{}
+	}
+	e.Site.Configs = configs
+}
+
+// Merge adds the nodes and edges of other into the callgraph. Callgraphs built from different
+// programs do not share addresses, so nodes are matched by function name and edges by their
+// readable string, and the addresses of the added funcs and sites are suffixed with ' where they
+// collide. The configs of matched nodes and edges are united.
+func (c *Callgraph) Merge(other *Callgraph) {
+	if other == nil {
+		return
+	}
+	nodesByName := make(map[string]*Node)
+	added := make([]*Func, 0)
+	for _, n := range c.Nodes {
+		if n.Func != nil {
+			nodesByName[n.Func.Name] = n
+		}
+	}
+	for _, n := range other.Nodes {
+		if n.Func == nil {
+			continue
+		}
+		if existing, ok := nodesByName[n.Func.Name]; ok {
+			existing.Func.Configs = unionConfigs(existing.Func.Configs, n.Func.Configs)
+			continue
+		}
+		fn := *n.Func
+		for _, ok := c.Nodes[fn.Addr]; ok; _, ok = c.Nodes[fn.Addr] {
+			fn.Addr = fmt.Sprintf("%s'", fn.Addr)
+		}
+		newNode := &Node{Func: &fn, ID: c.nextID()}
+		c.Nodes[fn.Addr] = newNode
+		nodesByName[fn.Name] = newNode
+		added = append(added, &fn)
+	}
+	// the parent and origin still refer to the funcs of other
+	for _, fn := range added {
+		fn.Parent = remapFunc(fn.Parent, nodesByName)
+		fn.Origin = remapFunc(fn.Origin, nodesByName)
+	}
+	edgesByReadable := make(map[string][]*Edge)
+	siteAddrs := make(map[string]bool)
+	for _, n := range c.Nodes {
+		for _, e := range n.Out {
+			edgesByReadable[e.ReadableString()] = append(edgesByReadable[e.ReadableString()], e)
+			if e.Site != nil {
+				siteAddrs[e.Site.Addr] = true
+			}
+		}
+		for _, e := range n.In {
+			edgesByReadable[e.ReadableString()] = append(edgesByReadable[e.ReadableString()], e)
+			if e.Site != nil {
+				siteAddrs[e.Site.Addr] = true
+			}
+		}
+	}
+	// the sites of other by their address, renamed where they collide with the sites of c
+	otherSiteAddrs := make(map[string]string)
+	for _, n := range other.Nodes {
+		for _, e := range n.Out {
+			if e.Caller == nil || e.Callee == nil || e.Caller.Func == nil || e.Callee.Func == nil {
+				continue
+			}
+			var configs []string
+			if e.Site != nil {
+				configs = e.Site.Configs
+			}
+			if existing, ok := edgesByReadable[e.ReadableString()]; ok {
+				for _, ee := range existing {
+					setEdgeConfigs(ee, unionConfigs(ee.Site.Configs, configs))
+				}
+				continue
+			}
+			caller := nodesByName[e.Caller.Func.Name]
+			callee := nodesByName[e.Callee.Func.Name]
+			site := &Site{Configs: configs}
+			if e.Site != nil {
+				site.Name = e.Site.Name
+				addr, ok := otherSiteAddrs[e.Site.Addr]
+				if !ok {
+					addr = e.Site.Addr
+					for siteAddrs[addr] {
+						addr = fmt.Sprintf("%s'", addr)
+					}
+					siteAddrs[addr] = true
+					otherSiteAddrs[e.Site.Addr] = addr
+				}
+				site.Addr = addr
+			}
+			if added := c.AddEdge(caller.Func.Addr, callee.Func.Addr, site); added != nil {
+				edgesByReadable[added.ReadableString()] = append(edgesByReadable[added.ReadableString()], added)
+			}
+		}
+	}
+	c.Configs = unionConfigs(c.Configs, other.Configs)
+	for k, v := range other.Unanalyzed {
+		if c.Unanalyzed == nil {
+			c.Unanalyzed = make(map[string]string)
+		}
+		if existing, ok := c.Unanalyzed[k]; ok {
+			v = existing + "; " + v
+		}
+		c.Unanalyzed[k] = v
+	}
+}
+
+// remapFunc returns a copy of fn with the address of the func of the same name in the callgraph,
+// fn itself if there is none.
+func remapFunc(fn *Func, nodesByName map[string]*Node) *Func {
+	if fn == nil {
+		return nil
+	}
+	n, ok := nodesByName[fn.Name]
+	if !ok {
+		return fn
+	}
+	remapped := *fn
+	remapped.Addr = n.Func.Addr
+	return &remapped
+}
+
+func unionConfigs(a, b []string) []string {
+	configs := make([]string, 0, len(a)+len(b))
+	seen := make(map[string]bool)
+	for _, v := range append(append([]string{}, a...), b...) {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		configs = append(configs, v)
+	}
+	return configs
+}
+
+// IntersectConfigs returns the configs contained in both a and b, an empty a or b means all configs.
+func IntersectConfigs(a, b []string) []string {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	inB := make(map[string]bool)
+	for _, v := range b {
+		inB[v] = true
+	}
+	configs := make([]string, 0)
+	for _, v := range a {
+		if inB[v] {
+			configs = append(configs, v)
+		}
+	}
+	return configs
+}
+
+// GetConfigsLabel returns the configs as a label suffix if they are only a part of all configs.
+func GetConfigsLabel(configs, allConfigs []string) string {
+	if len(allConfigs) <= 1 || len(configs) == 0 || len(configs) >= len(allConfigs) {
+		return ""
+	}
+	return fmt.Sprintf(" [%s]", strings.Join(configs, ","))
+}
@@ -0,0 +1,156 @@
+package ir
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// The stream format is a header followed by one record per node, each holding the func and the
+// edges of the node by node index. Records are encoded one by one, so neither writing nor reading
+// needs the whole encoded callgraph in memory.
+
+type streamHeader struct {
+	Root           *streamNode
+	Unanalyzed     map[string]string
+	Configs        []string
+	ClosuresFolded bool
+	NodeCount      int
+}
+
+type streamNode struct {
+	Func *Func
+	ID   int
+}
+
+type streamEdge struct {
+	Caller int
+	Callee int
+	Site   *Site
+}
+
+type streamNodeRecord struct {
+	Node streamNode
+	In   []streamEdge
+	Out  []streamEdge
+}
+
+// WriteCallgraph encodes the callgraph to w in the stream format.
+func WriteCallgraph(w io.Writer, c *Callgraph) error {
+	enc := gob.NewEncoder(w)
+	header := &streamHeader{
+		Unanalyzed:     c.Unanalyzed,
+		Configs:        c.Configs,
+		ClosuresFolded: c.ClosuresFolded,
+		NodeCount:      len(c.Nodes),
+	}
+	if c.Root != nil {
+		header.Root = &streamNode{Func: c.Root.Func, ID: c.Root.ID}
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	index := make(map[*Node]int, len(c.Nodes))
+	order := make([]*Node, 0, len(c.Nodes))
+	for _, n := range c.Nodes {
+		index[n] = len(order)
+		order = append(order, n)
+	}
+	getStreamEdges := func(edges []*Edge) ([]streamEdge, error) {
+		streamEdges := make([]streamEdge, 0, len(edges))
+		for _, e := range edges {
+			caller, ok := index[e.Caller]
+			callee, ok2 := index[e.Callee]
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("edge %s is not between nodes of the callgraph", e.ReadableString())
+			}
+			streamEdges = append(streamEdges, streamEdge{Caller: caller, Callee: callee, Site: e.Site})
+		}
+		return streamEdges, nil
+	}
+	for _, n := range order {
+		in, err := getStreamEdges(n.In)
+		if err != nil {
+			return err
+		}
+		out, err := getStreamEdges(n.Out)
+		if err != nil {
+			return err
+		}
+		record := &streamNodeRecord{
+			Node: streamNode{Func: n.Func, ID: n.ID},
+			In:   in,
+			Out:  out,
+		}
+		if err = enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadCallgraph decodes a callgraph written by WriteCallgraph from r.
+func ReadCallgraph(r io.Reader) (*Callgraph, error) {
+	dec := gob.NewDecoder(r)
+	header := &streamHeader{}
+	if err := dec.Decode(header); err != nil {
+		return nil, err
+	}
+	c := &Callgraph{
+		Nodes:          make(map[string]*Node, header.NodeCount),
+		Unanalyzed:     header.Unanalyzed,
+		Configs:        header.Configs,
+		ClosuresFolded: header.ClosuresFolded,
+	}
+	if header.Root != nil {
+		c.Root = &Node{Func: header.Root.Func, ID: header.Root.ID}
+	}
+	// the nodes are created before being read, as edges refer to the nodes of later records
+	nodes := make([]*Node, header.NodeCount)
+	for i := range nodes {
+		nodes[i] = &Node{}
+	}
+	getEdges := func(streamEdges []streamEdge) ([]*Edge, error) {
+		edges := make([]*Edge, 0, len(streamEdges))
+		for _, e := range streamEdges {
+			if e.Caller < 0 || e.Caller >= len(nodes) || e.Callee < 0 || e.Callee >= len(nodes) {
+				return nil, fmt.Errorf("edge node index out of range: %d->%d", e.Caller, e.Callee)
+			}
+			edges = append(edges, &Edge{Caller: nodes[e.Caller], Site: e.Site, Callee: nodes[e.Callee]})
+		}
+		return edges, nil
+	}
+	ins := make([][]*Edge, len(nodes))
+	outs := make([][]*Edge, len(nodes))
+	for i, n := range nodes {
+		record := &streamNodeRecord{}
+		if err := dec.Decode(record); err != nil {
+			return nil, err
+		}
+		n.Func = record.Node.Func
+		n.ID = record.Node.ID
+		in, err := getEdges(record.In)
+		if err != nil {
+			return nil, err
+		}
+		out, err := getEdges(record.Out)
+		if err != nil {
+			return nil, err
+		}
+		ins[i], outs[i] = in, out
+		if n.Func != nil {
+			c.Nodes[n.Func.Addr] = n
+		}
+	}
+	// the edges are added once all funcs are read, as their ids are made of the func addresses.
+	// adding them one by one indexes them and drops the duplicates of older entries
+	for i, n := range nodes {
+		for _, e := range ins[i] {
+			n.AddIn(e)
+		}
+		for _, e := range outs[i] {
+			n.AddOut(e)
+		}
+	}
+	return c, nil
+}
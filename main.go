@@ -1,39 +1,65 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/laindream/go-callflow-vis/analysis"
+	"github.com/laindream/go-callflow-vis/cache"
 	"github.com/laindream/go-callflow-vis/config"
 	"github.com/laindream/go-callflow-vis/log"
+	"github.com/laindream/go-callflow-vis/plugin"
+	"github.com/laindream/go-callflow-vis/progress"
 	"github.com/pkg/browser"
 	"io/fs"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const version = "0.1.0"
 
 const Usage = `Usage: go-callflow-vis [OPTIONS] PACKAGE...
+       go-callflow-vis cache [-cache-dir <cache_dir>] COMMAND (See go-callflow-vis cache -h)
+       go-callflow-vis schema (Print the JSON Schema of the config files)
+       go-callflow-vis init [OPTIONS] PACKAGE... (Propose a layered config, see go-callflow-vis init -h)
 Examples: (When you are in the root directory of the project)
     go-callflow-vis -config ./config.toml .
 Options:
-    -config <config_file> (Required): Path to the layer configuration file (e.g., config.toml).
-    -cache-dir <cache_dir> (Optional, Default: ./go_callflow_vis_cache): Directory to store cache files.
+    -config <config_file> (Required): Path to the layer configuration file (e.g., config.toml). Files ending with .yaml, .yml or .json are read as YAML or JSON with the same keys.
+    -cache-dir <cache_dir> (Optional, Default: ./.go_callflow_vis_cache): Directory to store cache files.
+    -cache-backend <backend> (Optional, Default: file): Where to store the cache. Possible values include: file, shared (a dir shared by concurrent runs, e.g. CI jobs, with file locking), memory (nothing is kept after the run).
     -out-dir <out_dir> (Optional, Default: .): Output directory for the generated files.
     -algo <algo> (Optional, Default: cha): The algorithm used to construct the call graph. Possible values include: static, cha, rta, pta, vta.
     -fast (Optional): Use fast mode to generate flow, which may lose some connectivity.
-    -query-dir <query_dir> (Optional, Default: ""): Directory to query from for Go packages. Uses the current directory if empty.
+    -max-rounds <max_rounds> (Optional, Default: 0): Max rounds of the bipartite search skipping issue functions. The flow may be partial when reached. 0 means unlimited.
+    -parallel <n> (Optional, Default: number of CPUs): Max number of concurrent reachability searches between layers. 1 searches sequentially.
+    -query-dir <query_dir> (Optional, Default: ""): Directory to query from for Go packages. Uses the current directory if empty. Multiple module roots can be separated with commas, the packages of all of them are analyzed as one program, cached by the sources of each module.
+    -workspace <go_work_file> (Optional, Default: ""): Path to a go.work file. All modules used by the workspace (or the ones given by -query-dir) are analyzed as one program.
     -tests (Optional): Consider test files as entry points for the call graph.
+    -allow-errors (Optional): Analyze the well-typed packages only instead of failing when packages contain errors. Skipped packages are reported as unanalyzed.
     -build <build_flags> (Optional, Default: ""): Build flags to pass to the Go build tool. Flags should be separated with spaces.
+    -plugins <plugins> (Optional, Default: ""): Plugins adding edges for handlers registered by function values. Separated with commas. Possible values include: http, grpc.
+    -fold-closures (Optional): Attribute the calls of anonymous closures (e.g. pkg.F$1) to their outermost named function, so only named functions appear in the flow.
+    -fold-generics (Optional): Render all instantiations of a generic function as one node.
     -skip-browser (Optional): Skip opening the browser automatically.
     -web (Optional): Serve the web visualization interface.
     -web-host <web_host> (Optional, Default: localhost): Host to serve the web interface on.
     -web-port <web_port> (Optional, Default: 45789): Port to serve the web interface on.
+    -timeout <duration> (Optional, Default: 0): Cancel the analysis after the duration (e.g. 10m), 0 means no timeout. A cancelled analysis (also by Ctrl-C) exits without caching the stage it was interrupted in, the stages finished before stay cached.
+    -low-memory (Optional): Lower the memory use on large programs. The flow undoes a log of its changes instead of restoring a serialized copy of the callgraph.
+    -progress (Optional): Display the phases of the analysis with their item counts and elapsed time.
+    -timings (Optional): Print a summary of the time spent and the peak heap in each phase at the end.
+    -trace <trace_file> (Optional, Default: ""): Write the phases to a JSON trace file, which can be opened by chrome://tracing or https://ui.perfetto.dev.
+    -explain (Optional): Print what the focus and ignore rules and each entity of the layers match, with near misses for the entities matching nothing, instead of generating the flow.
+    -explain-limit <n> (Optional, Default: 20): Max number of functions or sites listed per match by -explain. 0 lists all.
     -debug (Optional): Print debug information.
 Arguments:
     PACKAGE...: One or more Go packages to analyze.
@@ -43,25 +69,61 @@ Arguments:
 var (
 	configPath    = flag.String("config", "", "(Required)Path to the layer configuration file (e.g., config.toml)")
 	cacheDir      = flag.String("cache-dir", "", "Directory to store cache files")
+	cacheBackend  = flag.String("cache-backend", cache.BackendFile, fmt.Sprintf("Where to store the cache. Possible values include: %q, %q, %q", cache.BackendFile, cache.BackendShared, cache.BackendMemory))
 	outDir        = flag.String("out-dir", ".", "Output directory for the generated files")
 	callgraphAlgo = flag.String("algo", analysis.CallGraphTypeCha, fmt.Sprintf("The algorithm used to construct the call graph. Possible values inlcude: %q, %q, %q, %q, %q",
 		analysis.CallGraphTypeStatic, analysis.CallGraphTypeCha, analysis.CallGraphTypeRta, analysis.CallGraphTypePta, analysis.CallGraphTypeVta))
-	fastFlag    = flag.Bool("fast", false, "Use fast mode to generate flow, which may lose some connectivity")
-	queryDir    = flag.String("query-dir", "", "Directory to query from for go packages. Current dir if empty")
-	testFlag    = flag.Bool("tests", false, "Consider tests files as entry points for call-graph")
-	buildFlag   = flag.String("build", "", "Build flags to pass to Go build tool. Separated with spaces")
-	skipBrowser = flag.Bool("skip-browser", false, "Skip opening browser")
-	webFlag     = flag.Bool("web", false, "Serve web visualisation")
-	webHost     = flag.String("web-host", "localhost", "Host to serve the web on")
-	webPort     = flag.String("web-port", "45789", "Port to serve the web on")
-	debugFlag   = flag.Bool("debug", false, "Print debug information")
-	showVersion = flag.Bool("version", false, "Show version")
+	fastFlag     = flag.Bool("fast", false, "Use fast mode to generate flow, which may lose some connectivity")
+	maxRounds    = flag.Int("max-rounds", 0, "Max rounds of the bipartite search, 0 means unlimited")
+	parallel     = flag.Int("parallel", runtime.NumCPU(), "Max number of concurrent reachability searches between layers")
+	queryDir     = flag.String("query-dir", "", "Directory to query from for go packages. Current dir if empty. Separated with commas for multiple module roots")
+	workspace    = flag.String("workspace", "", "Path to a go.work file whose modules are analyzed as one program")
+	testFlag     = flag.Bool("tests", false, "Consider tests files as entry points for call-graph")
+	allowErrors  = flag.Bool("allow-errors", false, "Analyze the well-typed packages only when packages contain errors")
+	buildFlag    = flag.String("build", "", "Build flags to pass to Go build tool. Separated with spaces")
+	pluginsFlag  = flag.String("plugins", "", fmt.Sprintf("Plugins adding edges for handlers registered by function values. Separated with commas. Possible values include: %s", strings.Join(plugin.Names(), ", ")))
+	foldClosures = flag.Bool("fold-closures", false, "Attribute the calls of closures to their outermost named function")
+	foldGenerics = flag.Bool("fold-generics", false, "Render all instantiations of a generic function as one node")
+	skipBrowser  = flag.Bool("skip-browser", false, "Skip opening browser")
+	webFlag      = flag.Bool("web", false, "Serve web visualisation")
+	webHost      = flag.String("web-host", "localhost", "Host to serve the web on")
+	webPort      = flag.String("web-port", "45789", "Port to serve the web on")
+	timeout      = flag.Duration("timeout", 0, "Cancel the analysis after the duration, 0 means no timeout")
+	lowMemory    = flag.Bool("low-memory", false, "Lower the memory use on large programs")
+	progressFlag = flag.Bool("progress", false, "Display the phases of the analysis with their item counts and elapsed time")
+	timingsFlag  = flag.Bool("timings", false, "Print a summary of the time spent and the peak heap in each phase")
+	traceFile    = flag.String("trace", "", "Write the phases to a JSON trace file")
+	explainFlag  = flag.Bool("explain", false, "Print what the rules and entities of the config match instead of generating the flow")
+	explainLimit = flag.Int("explain-limit", 20, "Max number of functions or sites listed per match by -explain, 0 lists all")
+	debugFlag    = flag.Bool("debug", false, "Print debug information")
+	showVersion  = flag.Bool("version", false, "Show version")
 )
 
+func closeProgress() {
+	if err := progress.GetTracker().Close(); err != nil {
+		log.GetLogger().Errorf("failed to close progress: %v", err)
+	}
+	if *traceFile != "" {
+		log.GetLogger().Infof("trace written to %s", *traceFile)
+	}
+	if *timingsFlag {
+		fmt.Printf("Timings:\n%s", progress.GetTracker().Summary())
+	}
+}
+
 //go:embed static
 var FS embed.FS
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(runCacheCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		os.Exit(runInitCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		os.Exit(runSchemaCommand(os.Args[2:]))
+	}
 	flag.Parse()
 
 	if *showVersion {
@@ -80,9 +142,33 @@ func main() {
 	if len(*buildFlag) > 0 {
 		buildFlags = strings.Split(*buildFlag, " ")
 	}
+	var queryDirs []string
+	if len(*queryDir) > 0 {
+		queryDirs = strings.Split(*queryDir, ",")
+	}
+	var plugins []string
+	if len(*pluginsFlag) > 0 {
+		plugins = strings.Split(*pluginsFlag, ",")
+	}
 	if *debugFlag {
 		log.SetLogger(*debugFlag)
 	}
+	var sinks []progress.Sink
+	if *progressFlag {
+		sinks = append(sinks, progress.NewTerminalSink(os.Stderr))
+	}
+	if *traceFile != "" {
+		sinks = append(sinks, progress.NewTraceSink(*traceFile))
+	}
+	progress.SetTracker(progress.NewTracker(sinks...))
+	if *timingsFlag || *traceFile != "" {
+		progress.GetTracker().StartMemorySampler(50 * time.Millisecond)
+	}
+	c, err := cache.NewCache(*cacheBackend, *cacheDir)
+	if err != nil {
+		log.GetLogger().Errorf("failed to create cache: %v", err)
+		os.Exit(2)
+	}
 	conf, err := config.LoadConfig(*configPath)
 	if err != nil {
 		log.GetLogger().Errorf("failed to load config: %v", err)
@@ -90,43 +176,97 @@ func main() {
 	}
 	a := analysis.NewAnalysis(
 		conf,
-		*cacheDir,
+		c,
 		analysis.CallgraphType(*callgraphAlgo),
 		*testFlag,
-		*queryDir,
+		queryDirs,
+		*workspace,
 		args,
 		buildFlags,
+		plugins,
+		*allowErrors,
+		*foldClosures,
 		*fastFlag,
+		*maxRounds,
+		*parallel,
+		*lowMemory,
 	)
-	err = a.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if *explainFlag {
+		err = a.Explain(ctx, os.Stdout, *explainLimit)
+	} else {
+		err = a.Run(ctx)
+	}
+	stop()
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.GetLogger().Errorf("analysis timed out after %s, the stages finished before are cached, the interrupted ones are not", *timeout)
+		closeProgress()
+		os.Exit(1)
+	}
+	if errors.Is(err, context.Canceled) {
+		log.GetLogger().Errorf("analysis cancelled, the stages finished before are cached, the interrupted ones are not")
+		closeProgress()
+		os.Exit(130)
+	}
 	if err != nil {
 		log.GetLogger().Errorf("failed to run analysis: %v", err)
+		closeProgress()
 		os.Exit(1)
 	}
+	if *explainFlag {
+		closeProgress()
+		return
+	}
 	f := a.GetFlow()
 	if f == nil {
 		log.GetLogger().Errorf("failed to get flow")
 		os.Exit(1)
 	}
+	f.SetFoldGenerics(*foldGenerics)
 	out := *outDir
 	if strings.HasSuffix(out, "/") {
 		out = out[:len(out)-1]
 	}
+	renderPhase := progress.GetTracker().Start(progress.PhaseRender)
+	renderCount := 0
 	log.GetLogger().Debugf("saving paths to %s", fmt.Sprintf("%s/path_out", out))
 	err = f.SavePaths(fmt.Sprintf("%s/path_out", out), "")
 	if err != nil {
 		log.GetLogger().Errorf("failed to save paths: %v", err)
+	} else {
+		renderCount++
 	}
 	log.GetLogger().Debugf("saving simple callgraph to %s", fmt.Sprintf("%s/graph_out/simple_callgraph.dot", out))
 	err = f.SaveDot(fmt.Sprintf("%s/graph_out/simple_callgraph.dot", out), true)
 	if err != nil {
 		log.GetLogger().Errorf("failed to save simple graph: %v", err)
+	} else {
+		renderCount++
 	}
 	log.GetLogger().Debugf("saving complete callgraph to %s", fmt.Sprintf("%s/graph_out/complete_callgraph.dot", out))
 	err = f.SaveDot(fmt.Sprintf("%s/graph_out/complete_callgraph.dot", out), false)
 	if err != nil {
 		log.GetLogger().Errorf("failed to save complete graph: %v", err)
+	} else {
+		renderCount++
 	}
+	if len(f.GetUnanalyzed()) > 0 {
+		log.GetLogger().Warnf("%d packages unanalyzed because of errors, saving to %s",
+			len(f.GetUnanalyzed()), fmt.Sprintf("%s/unanalyzed.csv", out))
+		err = f.SaveUnanalyzed(fmt.Sprintf("%s/unanalyzed.csv", out), "")
+		if err != nil {
+			log.GetLogger().Errorf("failed to save unanalyzed packages: %v", err)
+		} else {
+			renderCount++
+		}
+	}
+	renderPhase.Done(renderCount)
+	closeProgress()
 	if *webFlag {
 		gin.SetMode(gin.ReleaseMode)
 		r := gin.Default()
@@ -134,6 +274,9 @@ func main() {
 			graph := f.GetRenderGraph()
 			c.JSON(200, graph)
 		})
+		r.GET("/unanalyzed", func(c *gin.Context) {
+			c.JSON(200, f.GetUnanalyzed())
+		})
 		r.GET("/dot", func(c *gin.Context) {
 			graph := f.GetDot(false)
 			c.String(200, graph)
@@ -1,6 +1,8 @@
 package mode
 
 import (
+	"fmt"
+	"github.com/laindream/go-callflow-vis/util"
 	"regexp"
 	"strings"
 )
@@ -13,59 +15,175 @@ var (
 	MatchTypeContain MatchType = "contain"
 	MatchTypeEqual   MatchType = "equal"
 	MatchTypeRegexp  MatchType = "regexp"
+	// MatchTypeGlob matches the whole string, * matches any characters and ? one character
+	MatchTypeGlob MatchType = "glob"
+	// the case-insensitive variants
+	MatchTypeIPrefix  MatchType = "iprefix"
+	MatchTypeISuffix  MatchType = "isuffix"
+	MatchTypeIContain MatchType = "icontain"
+	MatchTypeIEqual   MatchType = "iequal"
+	MatchTypeIRegexp  MatchType = "iregexp"
+	MatchTypeIGlob    MatchType = "iglob"
+	// the component types match a glob against a component of a function name, see
+	// util.ParseFuncName. The package also matches by its trailing path elements, e.g. "b" and
+	// "a/b" match "example.com/a/b".
+	MatchTypePackage  MatchType = "package"
+	MatchTypeReceiver MatchType = "receiver"
+	MatchTypeMethod   MatchType = "method"
 )
 
+var matchTypes = []MatchType{
+	MatchTypePrefix, MatchTypeSuffix, MatchTypeContain, MatchTypeEqual, MatchTypeRegexp, MatchTypeGlob,
+	MatchTypeIPrefix, MatchTypeISuffix, MatchTypeIContain, MatchTypeIEqual, MatchTypeIRegexp, MatchTypeIGlob,
+	MatchTypePackage, MatchTypeReceiver, MatchTypeMethod,
+}
+
+// GetMatchTypes returns the match types of the rules.
+func GetMatchTypes() []MatchType {
+	return append([]MatchType{}, matchTypes...)
+}
+
+// Mode combines its rules by and or or, a rule may itself combine rules, e.g.
+//
+//	and = true, rules = [{ or = true, rules = [...] }, { not = true, type = "contain", content = "Test" }]
 type Mode struct {
-	OR    bool   `toml:"or" json:"or"`
-	AND   bool   `toml:"and" json:"and"`
-	Rules []Rule `toml:"rules" json:"rules"`
+	OR    bool   `toml:"or" yaml:"or" json:"or"`
+	AND   bool   `toml:"and" yaml:"and" json:"and"`
+	Not   bool   `toml:"not" yaml:"not" json:"not,omitempty"`
+	Rules []Rule `toml:"rules" yaml:"rules" json:"rules"`
+}
+
+// Compile validates the mode and compiles its rules. Several rules need exactly one of and and or.
+func (m *Mode) Compile() error {
+	return compileRules(m.AND, m.OR, m.Rules)
+}
+
+// Expand replaces the content of the rules by expand, e.g. to substitute variables. The content of
+// regexp and iregexp rules is left as is.
+func (m *Mode) Expand(expand func(content string) (string, error)) error {
+	return expandRules(m.Rules, expand)
 }
 
 func (m *Mode) Match(s string) bool {
-	if len(m.Rules) == 0 {
+	return matchRules(m.AND, m.OR, m.Rules, s) != m.Not
+}
+
+func compileRules(and, or bool, rules []Rule) error {
+	if or && and {
+		return &Error{Err: fmt.Errorf("and and or are both set")}
+	}
+	if len(rules) > 1 && !or && !and {
+		return &Error{Err: fmt.Errorf("%d rules need either and = true or or = true", len(rules))}
+	}
+	for i, _ := range rules {
+		if err := rules[i].Compile(); err != nil {
+			return WithPath(fmt.Sprintf("rules[%d]", i), err)
+		}
+	}
+	return nil
+}
+
+func expandRules(rules []Rule, expand func(content string) (string, error)) error {
+	for i, _ := range rules {
+		if len(rules[i].Rules) > 0 {
+			if err := expandRules(rules[i].Rules, expand); err != nil {
+				return WithPath(fmt.Sprintf("rules[%d]", i), err)
+			}
+			continue
+		}
+		if t := rules[i].GetType(); t == MatchTypeRegexp || t == MatchTypeIRegexp {
+			// ${ is valid regexp syntax
+			continue
+		}
+		content, err := expand(rules[i].Content)
+		if err != nil {
+			return WithPath(fmt.Sprintf("rules[%d].content", i), err)
+		}
+		rules[i].Content = content
+	}
+	return nil
+}
+
+func matchRules(and, or bool, rules []Rule, s string) bool {
+	if len(rules) == 0 {
 		return false
 	}
-	if len(m.Rules) == 1 {
-		return m.Rules[0].Match(s)
+	if len(rules) == 1 {
+		return rules[0].Match(s)
 	}
-	if m.OR == m.AND {
+	if or == and {
 		return false
 	}
-	if m.OR {
-		for _, item := range m.Rules {
-			if item.Match(s) {
+	if or {
+		for i, _ := range rules {
+			if rules[i].Match(s) {
 				return true
 			}
 		}
 		return false
 	}
-	for _, item := range m.Rules {
-		if !item.Match(s) {
+	for i, _ := range rules {
+		if !rules[i].Match(s) {
 			return false
 		}
 	}
 	return true
 }
 
+// Rule matches by its type and content, or combines its rules like a Mode when they are set.
 type Rule struct {
-	Exclude bool      `toml:"exclude" json:"exclude"`
-	Type    MatchType `toml:"type" json:"type"`
-	Content string    `toml:"content" json:"content"`
+	Exclude bool      `toml:"exclude" yaml:"exclude" json:"exclude"`
+	Type    MatchType `toml:"type" yaml:"type" json:"type"`
+	Content string    `toml:"content" yaml:"content" json:"content"`
+	// Not is the same as Exclude
+	Not   bool   `toml:"not" yaml:"not" json:"not,omitempty"`
+	OR    bool   `toml:"or" yaml:"or" json:"or,omitempty"`
+	AND   bool   `toml:"and" yaml:"and" json:"and,omitempty"`
+	Rules []Rule `toml:"rules" yaml:"rules" json:"rules,omitempty"`
+	// re is the regexp compiled by Compile
+	re *regexp.Regexp
+}
+
+// GetType returns the match type of the rule, equal when not set.
+func (m *Rule) GetType() MatchType {
+	if m.Type == "" {
+		return MatchTypeEqual
+	}
+	return m.Type
+}
+
+// String describes the rule, e.g. `prefix "example.com/a"` or `not or of 2 rules`.
+func (m *Rule) String() string {
+	s := fmt.Sprintf("%s %q", m.GetType(), m.Content)
+	if len(m.Rules) > 0 {
+		op := "and"
+		if m.OR {
+			op = "or"
+		}
+		s = fmt.Sprintf("%s of %d rules", op, len(m.Rules))
+		if len(m.Rules) == 1 {
+			s = m.Rules[0].String()
+		}
+	}
+	if m.Exclude || m.Not {
+		return "not " + s
+	}
+	return s
 }
 
 func (m *Rule) Match(s string) (result bool) {
 	defer func() {
-		if m.Exclude {
+		if m.Exclude || m.Not {
 			result = !result
 		}
 	}()
+	if len(m.Rules) > 0 {
+		return matchRules(m.AND, m.OR, m.Rules, s)
+	}
 	if m.Content == "" {
 		return false
 	}
-	if m.Type == "" {
-		m.Type = MatchTypeEqual
-	}
-	switch m.Type {
+	switch t := m.GetType(); t {
 	case MatchTypePrefix:
 		return strings.HasPrefix(s, m.Content)
 	case MatchTypeSuffix:
@@ -74,18 +192,140 @@ func (m *Rule) Match(s string) (result bool) {
 		return strings.Contains(s, m.Content)
 	case MatchTypeEqual:
 		return s == m.Content
-	case MatchTypeRegexp:
-		r, err := regexp.Compile(m.Content)
-		if err != nil {
-			return false
+	case MatchTypeIPrefix:
+		return strings.HasPrefix(strings.ToLower(s), strings.ToLower(m.Content))
+	case MatchTypeISuffix:
+		return strings.HasSuffix(strings.ToLower(s), strings.ToLower(m.Content))
+	case MatchTypeIContain:
+		return strings.Contains(strings.ToLower(s), strings.ToLower(m.Content))
+	case MatchTypeIEqual:
+		return strings.EqualFold(s, m.Content)
+	case MatchTypeRegexp, MatchTypeIRegexp, MatchTypeGlob, MatchTypeIGlob,
+		MatchTypePackage, MatchTypeReceiver, MatchTypeMethod:
+		r := m.re
+		if r == nil {
+			// not compiled, e.g. a rule built in code
+			var err error
+			r, err = m.compileRegexp()
+			if err != nil {
+				return false
+			}
 		}
-		return r.MatchString(s)
+		return matchRegexp(t, r, s)
 	}
 	return false
 }
 
+func matchRegexp(t MatchType, r *regexp.Regexp, s string) bool {
+	switch t {
+	case MatchTypePackage:
+		pkg, _, _ := util.ParseFuncName(s)
+		for pkg != "" {
+			if r.MatchString(pkg) {
+				return true
+			}
+			i := strings.Index(pkg, "/")
+			if i < 0 {
+				return false
+			}
+			pkg = pkg[i+1:]
+		}
+		return false
+	case MatchTypeReceiver:
+		_, receiver, _ := util.ParseFuncName(s)
+		return receiver != "" && r.MatchString(receiver)
+	case MatchTypeMethod:
+		_, _, fn := util.ParseFuncName(s)
+		return r.MatchString(fn)
+	}
+	return r.MatchString(s)
+}
+
+// Compile validates the rule and compiles its regexp. A rule with an empty content is valid and
+// never matches.
+func (m *Rule) Compile() error {
+	if m.Exclude && m.Not {
+		return &Error{Err: fmt.Errorf("exclude and not are both set")}
+	}
+	if len(m.Rules) > 0 {
+		if m.Type != "" || m.Content != "" {
+			return &Error{Err: fmt.Errorf("a rule with rules has no type or content")}
+		}
+		return compileRules(m.AND, m.OR, m.Rules)
+	}
+	if m.AND || m.OR {
+		return &Error{Err: fmt.Errorf("and or or is set without rules")}
+	}
+	switch m.GetType() {
+	case MatchTypePrefix, MatchTypeSuffix, MatchTypeContain, MatchTypeEqual,
+		MatchTypeIPrefix, MatchTypeISuffix, MatchTypeIContain, MatchTypeIEqual:
+		return nil
+	case MatchTypeRegexp, MatchTypeIRegexp, MatchTypeGlob, MatchTypeIGlob,
+		MatchTypePackage, MatchTypeReceiver, MatchTypeMethod:
+		r, err := m.compileRegexp()
+		if err != nil {
+			return &Error{Path: "content", Err: fmt.Errorf("invalid %s: %v", m.GetType(), err)}
+		}
+		m.re = r
+		return nil
+	}
+	types := make([]string, 0, len(matchTypes))
+	for _, t := range matchTypes {
+		types = append(types, string(t))
+	}
+	return &Error{Path: "type", Err: fmt.Errorf("unknown match type %q, possible values include: %s",
+		m.Type, strings.Join(types, ", "))}
+}
+
+func (m *Rule) compileRegexp() (*regexp.Regexp, error) {
+	switch m.GetType() {
+	case MatchTypeRegexp:
+		return regexp.Compile(m.Content)
+	case MatchTypeIRegexp:
+		return regexp.Compile("(?i)" + m.Content)
+	case MatchTypeIGlob:
+		return regexp.Compile("(?i)" + globToRegexp(m.Content))
+	}
+	return regexp.Compile(globToRegexp(m.Content))
+}
+
+// globToRegexp returns the anchored regexp of the glob, other characters than * and ? are literal.
+func globToRegexp(glob string) string {
+	sb := strings.Builder{}
+	sb.WriteString("^")
+	literal := strings.Builder{}
+	flush := func() {
+		sb.WriteString(regexp.QuoteMeta(literal.String()))
+		literal.Reset()
+	}
+	for _, c := range glob {
+		switch c {
+		case '*':
+			flush()
+			sb.WriteString(".*")
+		case '?':
+			flush()
+			sb.WriteString(".")
+		default:
+			literal.WriteRune(c)
+		}
+	}
+	flush()
+	sb.WriteString("$")
+	return sb.String()
+}
+
 type Set []*Mode
 
+func (ms Set) Compile() error {
+	for i, m := range ms {
+		if err := m.Compile(); err != nil {
+			return WithPath(fmt.Sprintf("[%d]", i), err)
+		}
+	}
+	return nil
+}
+
 func (ms Set) Match(s string) bool {
 	for _, m := range ms {
 		if m.Match(s) {
@@ -94,3 +334,35 @@ func (ms Set) Match(s string) bool {
 	}
 	return false
 }
+
+// Error is an error of a mode or rule at a key path, e.g. rules[1].type.
+type Error struct {
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// WithPath prefixes the key path of the error with path, e.g. the key of the mode in a config.
+func WithPath(path string, err error) error {
+	e, ok := err.(*Error)
+	if !ok {
+		return &Error{Path: path, Err: err}
+	}
+	switch {
+	case e.Path == "":
+		return &Error{Path: path, Err: e.Err}
+	case strings.HasPrefix(e.Path, "["):
+		return &Error{Path: path + e.Path, Err: e.Err}
+	}
+	return &Error{Path: path + "." + e.Path, Err: e.Err}
+}
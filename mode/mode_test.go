@@ -0,0 +1,218 @@
+package mode
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	funcA   = "example.com/a/b.Handle"
+	methodA = "(*example.com/a/b.Service).Handle"
+	testA   = "example.com/a/b.TestHandle"
+	funcC   = "example.com/c.Query"
+)
+
+func TestModeMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		mode *Mode
+		// match are the names matched, the others of the names are not
+		match []string
+	}{
+		{
+			name:  "empty content never matches",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypePrefix}}},
+			match: nil,
+		},
+		{
+			name:  "empty regexp content never matches",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypeRegexp}}},
+			match: nil,
+		},
+		{
+			name:  "excluded empty content matches all",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypeContain, Exclude: true}}},
+			match: []string{funcA, methodA, testA, funcC},
+		},
+		{
+			name:  "equal by default",
+			mode:  &Mode{Rules: []Rule{{Content: funcC}}},
+			match: []string{funcC},
+		},
+		{
+			name:  "glob matches the whole name",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypeGlob, Content: "example.com/?/b.*Handle"}}},
+			match: []string{funcA, testA},
+		},
+		{
+			name:  "glob quotes other characters",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypeGlob, Content: "(*example.com/a/b.Service).*"}}},
+			match: []string{methodA},
+		},
+		{
+			name:  "iglob",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypeIGlob, Content: "EXAMPLE.COM/C.*"}}},
+			match: []string{funcC},
+		},
+		{
+			name:  "iregexp",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypeIRegexp, Content: `\.test`}}},
+			match: []string{testA},
+		},
+		{
+			name:  "icontain",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypeIContain, Content: "SERVICE"}}},
+			match: []string{methodA},
+		},
+		{
+			name:  "package by trailing path elements",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypePackage, Content: "a/b"}}},
+			match: []string{funcA, methodA, testA},
+		},
+		{
+			name:  "receiver",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypeReceiver, Content: "Serv*"}}},
+			match: []string{methodA},
+		},
+		{
+			name:  "method",
+			mode:  &Mode{Rules: []Rule{{Type: MatchTypeMethod, Content: "Handle"}}},
+			match: []string{funcA, methodA},
+		},
+		{
+			name: "and with an excluded rule",
+			mode: &Mode{AND: true, Rules: []Rule{
+				{Type: MatchTypePackage, Content: "b"},
+				{Type: MatchTypeContain, Content: "Test", Not: true},
+			}},
+			match: []string{funcA, methodA},
+		},
+		{
+			name: "nested or in and",
+			mode: &Mode{AND: true, Rules: []Rule{
+				{OR: true, Rules: []Rule{
+					{Type: MatchTypeSuffix, Content: ".Query"},
+					{Type: MatchTypeReceiver, Content: "Service"},
+				}},
+				{Type: MatchTypePrefix, Content: "example.com/c.", Not: true},
+			}},
+			match: []string{methodA},
+		},
+		{
+			name: "negated nested rule",
+			mode: &Mode{Rules: []Rule{
+				{Not: true, AND: true, Rules: []Rule{
+					{Type: MatchTypePackage, Content: "b"},
+					{Type: MatchTypeMethod, Content: "Handle"},
+				}},
+			}},
+			match: []string{testA, funcC},
+		},
+		{
+			name: "negated mode",
+			mode: &Mode{Not: true, OR: true, Rules: []Rule{
+				{Type: MatchTypeMethod, Content: "Handle"},
+				{Type: MatchTypeContain, Content: "Test"},
+			}},
+			match: []string{funcC},
+		},
+	}
+	names := []string{funcA, methodA, testA, funcC}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.mode.Compile(); err != nil {
+				t.Fatal(err)
+			}
+			match := make(map[string]bool)
+			for _, s := range tt.match {
+				match[s] = true
+			}
+			for _, s := range names {
+				if got := tt.mode.Match(s); got != match[s] {
+					t.Errorf("Match(%q) = %v, want %v", s, got, match[s])
+				}
+			}
+		})
+	}
+}
+
+func TestModeCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		mode *Mode
+		// want is the start of the error
+		want string
+	}{
+		{
+			name: "several rules without and or or",
+			mode: &Mode{Rules: []Rule{{Content: "a"}, {Content: "b"}}},
+			want: "2 rules need either and = true or or = true",
+		},
+		{
+			name: "and and or",
+			mode: &Mode{AND: true, OR: true, Rules: []Rule{{Content: "a"}}},
+			want: "and and or are both set",
+		},
+		{
+			name: "invalid nested regexp",
+			mode: &Mode{OR: true, Rules: []Rule{
+				{Content: "a"},
+				{AND: true, Rules: []Rule{{Type: MatchTypeRegexp, Content: "("}}},
+			}},
+			want: "rules[1].rules[0].content: invalid regexp",
+		},
+		{
+			name: "exclude and not",
+			mode: &Mode{Rules: []Rule{{Content: "a", Exclude: true, Not: true}}},
+			want: "rules[0]: exclude and not are both set",
+		},
+		{
+			name: "rules with content",
+			mode: &Mode{Rules: []Rule{{Content: "a", Rules: []Rule{{Content: "b"}}}}},
+			want: "rules[0]: a rule with rules has no type or content",
+		},
+		{
+			name: "unknown type",
+			mode: &Mode{Rules: []Rule{{Type: "like", Content: "a"}}},
+			want: `rules[0].type: unknown match type "like"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.mode.Compile()
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestModeExpand(t *testing.T) {
+	m := &Mode{OR: true, Rules: []Rule{
+		{Type: MatchTypePrefix, Content: "${module}/a."},
+		{Type: MatchTypeRegexp, Content: `^\${x}$`},
+		{AND: true, Rules: []Rule{
+			{Type: MatchTypeGlob, Content: "${module}/*"},
+			{Type: MatchTypeIRegexp, Content: "${module}"},
+		}},
+	}}
+	err := m.Expand(func(content string) (string, error) {
+		return strings.ReplaceAll(content, "${module}", "example.com"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"example.com/a.", `^\${x}$`, "example.com/*", "${module}"}
+	got := []string{m.Rules[0].Content, m.Rules[1].Content, m.Rules[2].Rules[0].Content, m.Rules[2].Rules[1].Content}
+	for i, _ := range want {
+		if got[i] != want[i] {
+			t.Errorf("content %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+	if err = m.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Match("${x}") {
+		t.Errorf("the regexp rule does not match its literal")
+	}
+}
@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"github.com/laindream/go-callflow-vis/ir"
+	"go/types"
+	"golang.org/x/tools/go/ssa"
+	"strings"
+)
+
+const (
+	PluginNameGRPC = "grpc"
+	grpcPkgPath    = "google.golang.org/grpc"
+)
+
+func init() {
+	Register(&GRPCPlugin{})
+}
+
+// GRPCPlugin links the function calling a generated RegisterXServer to every
+// service method implemented by the registered server.
+type GRPCPlugin struct{}
+
+func (p *GRPCPlugin) Name() string {
+	return PluginNameGRPC
+}
+
+func (p *GRPCPlugin) Apply(prog *ssa.Program, callgraph *ir.Callgraph) (int, error) {
+	count := 0
+	forEachStaticCall(prog, func(call ssa.CallInstruction, callee *ssa.Function) {
+		if !isGRPCRegisterFunc(callee) {
+			return
+		}
+		iface, ok := callee.Signature.Params().At(1).Type().Underlying().(*types.Interface)
+		if !ok {
+			return
+		}
+		impl := concreteType(call.Common().Args[1])
+		if impl == nil {
+			return
+		}
+		mset := prog.MethodSets.MethodSet(impl.Type())
+		for i := 0; i < iface.NumMethods(); i++ {
+			m := iface.Method(i)
+			if !m.Exported() {
+				continue
+			}
+			sel := mset.Lookup(m.Pkg(), m.Name())
+			if sel == nil {
+				continue
+			}
+			if addRegisterEdge(callgraph, call, prog.MethodValue(sel)) {
+				count++
+			}
+		}
+	})
+	return count, nil
+}
+
+// isGRPCRegisterFunc reports whether fn looks like protoc-gen-go-grpc generated
+// func RegisterXServer(s grpc.ServiceRegistrar, srv XServer).
+func isGRPCRegisterFunc(fn *ssa.Function) bool {
+	if fn.Signature.Recv() != nil || fn.Signature.Params().Len() != 2 {
+		return false
+	}
+	if !strings.HasPrefix(fn.Name(), "Register") || !strings.HasSuffix(fn.Name(), "Server") {
+		return false
+	}
+	return strings.Contains(fn.Signature.Params().At(0).Type().String(), grpcPkgPath+".")
+}
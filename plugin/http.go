@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"github.com/laindream/go-callflow-vis/ir"
+	"golang.org/x/tools/go/ssa"
+)
+
+const PluginNameHTTP = "http"
+
+var (
+	httpHandleFuncs = map[string]bool{
+		"net/http.HandleFunc":             true,
+		"(*net/http.ServeMux).HandleFunc": true,
+	}
+	httpHandles = map[string]bool{
+		"net/http.Handle":             true,
+		"(*net/http.ServeMux).Handle": true,
+	}
+)
+
+func init() {
+	Register(&HTTPPlugin{})
+}
+
+// HTTPPlugin links the function registering a net/http handler to the handler itself.
+type HTTPPlugin struct{}
+
+func (p *HTTPPlugin) Name() string {
+	return PluginNameHTTP
+}
+
+func (p *HTTPPlugin) Apply(prog *ssa.Program, callgraph *ir.Callgraph) (int, error) {
+	count := 0
+	forEachStaticCall(prog, func(call ssa.CallInstruction, callee *ssa.Function) {
+		name := callee.String()
+		if !httpHandleFuncs[name] && !httpHandles[name] {
+			return
+		}
+		args := call.Common().Args
+		if len(args) == 0 {
+			return
+		}
+		handler := args[len(args)-1]
+		var target *ssa.Function
+		if httpHandleFuncs[name] {
+			target = resolveFunc(handler)
+		} else if x := concreteType(handler); x != nil {
+			// http.HandlerFunc(f) is a function value, other handlers are dispatched by ServeHTTP
+			if target = resolveFunc(x); target == nil {
+				target = lookupMethod(prog, x, "ServeHTTP")
+			}
+		}
+		if addRegisterEdge(callgraph, call, target) {
+			count++
+		}
+	})
+	return count, nil
+}
+
+func lookupMethod(prog *ssa.Program, v ssa.Value, name string) *ssa.Function {
+	sel := prog.MethodSets.MethodSet(v.Type()).Lookup(nil, name)
+	if sel == nil {
+		return nil
+	}
+	return prog.MethodValue(sel)
+}
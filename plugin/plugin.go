@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/laindream/go-callflow-vis/ir"
+	"github.com/laindream/go-callflow-vis/log"
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/ssa/ssautil"
+	"sort"
+)
+
+// Plugin contributes edges to the callgraph that the callgraph algorithms can not see,
+// e.g. handlers stored in registries and invoked through function values.
+type Plugin interface {
+	Name() string
+	// Apply inspects the program and adds edges into callgraph, it returns the number of edges added.
+	Apply(prog *ssa.Program, callgraph *ir.Callgraph) (int, error)
+}
+
+// registry holds the plugins by name, each plugin registers itself in the init of its file.
+var registry = make(map[string]Plugin)
+
+// Register makes the plugin available by its name, replacing a plugin of the same name.
+func Register(p Plugin) {
+	registry[p.Name()] = p
+}
+
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for k, _ := range registry {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func GetPlugins(names []string) ([]Plugin, error) {
+	plugins := make([]Plugin, 0, len(names))
+	for _, name := range names {
+		p, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown plugin: %s, available plugins: %v", name, Names())
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+func Apply(plugins []Plugin, prog *ssa.Program, callgraph *ir.Callgraph) error {
+	if prog == nil || callgraph == nil {
+		return fmt.Errorf("program or callgraph is nil")
+	}
+	for _, p := range plugins {
+		count, err := p.Apply(prog, callgraph)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %v", p.Name(), err)
+		}
+		log.GetLogger().Debugf("Plugin %s: %d edges added", p.Name(), count)
+	}
+	return nil
+}
+
+// forEachStaticCall calls fn for every statically dispatched call in the program.
+func forEachStaticCall(prog *ssa.Program, fn func(call ssa.CallInstruction, callee *ssa.Function)) {
+	for f, _ := range ssautil.AllFunctions(prog) {
+		for _, b := range f.Blocks {
+			for _, instr := range b.Instrs {
+				call, ok := instr.(ssa.CallInstruction)
+				if !ok {
+					continue
+				}
+				callee := call.Common().StaticCallee()
+				if callee == nil {
+					continue
+				}
+				fn(call, callee)
+			}
+		}
+	}
+}
+
+// resolveFunc finds the source function behind a function value.
+func resolveFunc(v ssa.Value) *ssa.Function {
+	switch v := v.(type) {
+	case *ssa.Function:
+		if v.Synthetic == "" {
+			return v
+		}
+		// bound method and thunk wrappers only forward to the wrapped function
+		for _, b := range v.Blocks {
+			for _, instr := range b.Instrs {
+				if call, ok := instr.(ssa.CallInstruction); ok {
+					if callee := call.Common().StaticCallee(); callee != nil {
+						return resolveFunc(callee)
+					}
+				}
+			}
+		}
+	case *ssa.MakeClosure:
+		return resolveFunc(v.Fn)
+	case *ssa.ChangeType:
+		return resolveFunc(v.X)
+	case *ssa.MakeInterface:
+		return resolveFunc(v.X)
+	}
+	return nil
+}
+
+// concreteType returns the dynamic type of an interface value if it is known statically.
+func concreteType(v ssa.Value) ssa.Value {
+	switch v := v.(type) {
+	case *ssa.MakeInterface:
+		return v.X
+	case *ssa.ChangeInterface:
+		return concreteType(v.X)
+	}
+	return nil
+}
+
+func addRegisterEdge(callgraph *ir.Callgraph, call ssa.CallInstruction, callee *ssa.Function) bool {
+	caller := call.Parent()
+	if caller == nil || callee == nil {
+		return false
+	}
+	if callgraph.ClosuresFolded {
+		caller = ir.GetNamedFunc(caller)
+		callee = ir.GetNamedFunc(callee)
+	}
+	callerNode := callgraph.AddNode(ir.GetFuncIR(caller))
+	calleeNode := callgraph.AddNode(ir.GetFuncIR(callee))
+	return callgraph.AddEdge(callerNode.Func.Addr, calleeNode.Func.Addr, &ir.Site{
+		Name: call.String(),
+		Addr: fmt.Sprintf("%p", call),
+	}) != nil
+}
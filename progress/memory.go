@@ -0,0 +1,69 @@
+package progress
+
+import (
+	"fmt"
+	"runtime/metrics"
+	"time"
+)
+
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// StartMemorySampler samples the heap every interval and on every event, recording the peak of
+// the whole run and of each running phase. It is stopped by Close.
+func (t *Tracker) StartMemorySampler(interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopSampler != nil {
+		return
+	}
+	stop := make(chan struct{})
+	t.stopSampler = stop
+	t.sampleMemoryLocked()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.mu.Lock()
+				t.sampleMemoryLocked()
+				t.mu.Unlock()
+			}
+		}
+	}()
+}
+
+func (t *Tracker) sampleMemoryLocked() {
+	if t.stopSampler == nil {
+		return
+	}
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return
+	}
+	heap := sample[0].Value.Uint64()
+	if heap > t.peak {
+		t.peak = heap
+	}
+	for _, p := range t.phases {
+		if p.End.IsZero() && heap > p.Peak {
+			p.Peak = heap
+		}
+	}
+}
+
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,224 @@
+package progress
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PhaseLoad      = "load"
+	PhaseSSA       = "ssa build"
+	PhaseCallgraph = "callgraph"
+	PhaseConvert   = "convert"
+	PhasePlugins   = "plugins"
+	PhaseMerge     = "merge"
+	PhaseFilter    = "filter"
+	PhaseMinGraph  = "min graph"
+	PhaseBipartite = "bipartite"
+	PhaseRender    = "render"
+	// the counts of the cache phases are bytes
+	PhaseCacheRead  = "cache read"
+	PhaseCacheWrite = "cache write"
+)
+
+const (
+	StatusStart  = "start"
+	StatusUpdate = "update"
+	StatusDone   = "done"
+)
+
+type Event struct {
+	Phase   string        `json:"phase"`
+	Status  string        `json:"status"`
+	Count   int           `json:"count"`
+	Message string        `json:"message,omitempty"`
+	Time    time.Time     `json:"time"`
+	Elapsed time.Duration `json:"elapsed"`
+	Peak    uint64        `json:"peak,omitempty"`
+}
+
+// Sink receives the events of a tracker, e.g. to display or record them.
+type Sink interface {
+	Handle(e *Event)
+	Close() error
+}
+
+var tracker = NewTracker()
+
+func GetTracker() *Tracker {
+	return tracker
+}
+
+func SetTracker(t *Tracker) {
+	tracker = t
+}
+
+type Tracker struct {
+	mu     sync.Mutex
+	start  time.Time
+	sinks  []Sink
+	phases []*Phase
+	scope  string
+	// peak is the peak heap sampled after StartMemorySampler
+	peak        uint64
+	stopSampler chan struct{}
+}
+
+func NewTracker(sinks ...Sink) *Tracker {
+	return &Tracker{
+		start: time.Now(),
+		sinks: sinks,
+	}
+}
+
+type Phase struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+	Count int
+	// Peak is the peak heap while the phase ran, 0 without the memory sampler
+	Peak uint64
+	t    *Tracker
+}
+
+// Start begins a phase, which is ended by Done. Phases may be repeated, e.g. the load phase
+// once per build of a build matrix.
+func (t *Tracker) Start(name string) *Phase {
+	t.mu.Lock()
+	if t.scope != "" {
+		name = fmt.Sprintf("%s [%s]", name, t.scope)
+	}
+	p := &Phase{
+		Name:  name,
+		Start: time.Now(),
+		t:     t,
+	}
+	t.phases = append(t.phases, p)
+	t.sampleMemoryLocked()
+	t.mu.Unlock()
+	t.emit(&Event{Phase: name, Status: StatusStart, Time: p.Start})
+	return p
+}
+
+// SetScope labels the phases started afterwards, e.g. with the build of a build matrix. An
+// empty scope removes the label.
+func (t *Tracker) SetScope(scope string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.scope = scope
+}
+
+// Update reports the items processed so far by the phase.
+func (p *Phase) Update(count int, format string, v ...interface{}) {
+	now := time.Now()
+	p.t.emit(&Event{
+		Phase:   p.Name,
+		Status:  StatusUpdate,
+		Count:   count,
+		Message: fmt.Sprintf(format, v...),
+		Time:    now,
+		Elapsed: now.Sub(p.Start),
+	})
+}
+
+// Done ends the phase with the number of items it produced.
+func (p *Phase) Done(count int) {
+	p.t.mu.Lock()
+	p.t.sampleMemoryLocked()
+	p.End = time.Now()
+	p.Count = count
+	p.t.mu.Unlock()
+	p.t.emit(&Event{
+		Phase:   p.Name,
+		Status:  StatusDone,
+		Count:   count,
+		Time:    p.End,
+		Elapsed: p.End.Sub(p.Start),
+		Peak:    p.Peak,
+	})
+}
+
+func (p *Phase) Elapsed() time.Duration {
+	if p.End.IsZero() {
+		return time.Since(p.Start)
+	}
+	return p.End.Sub(p.Start)
+}
+
+func (t *Tracker) emit(e *Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.sinks {
+		s.Handle(e)
+	}
+}
+
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopSampler != nil {
+		t.sampleMemoryLocked()
+		close(t.stopSampler)
+		t.stopSampler = nil
+	}
+	var errs []string
+	for _, s := range t.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("closing progress sinks: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Summary returns the timings of the phases in start order, with their share of the total time.
+func (t *Tracker) Summary() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := time.Since(t.start)
+	width := len("phase")
+	for _, p := range t.phases {
+		if len(p.Name) > width {
+			width = len(p.Name)
+		}
+	}
+	sb := strings.Builder{}
+	withPeak := t.peak > 0
+	sb.WriteString(fmt.Sprintf("%-*s %12s %7s %10s", width, "phase", "elapsed", "share", "count"))
+	if withPeak {
+		sb.WriteString(fmt.Sprintf(" %10s", "peak heap"))
+	}
+	sb.WriteString("\n")
+	for _, p := range t.phases {
+		sb.WriteString(fmt.Sprintf("%-*s %12s %6.1f%% %10d", width, p.Name,
+			round(p.Elapsed()), percent(p.Elapsed(), total), p.Count))
+		if withPeak {
+			sb.WriteString(fmt.Sprintf(" %10s", formatBytes(p.Peak)))
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString(fmt.Sprintf("%-*s %12s", width, "total", round(total)))
+	if withPeak {
+		sb.WriteString(fmt.Sprintf(" %7s %10s %10s", "", "", formatBytes(t.peak)))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+func percent(d, total time.Duration) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(d) * 100 / float64(total)
+}
+
+func round(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,48 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// TerminalSink displays the running phase on one line, rewritten on every event. If the output
+// is not a terminal, only the finished phases are printed, one per line.
+type TerminalSink struct {
+	w          io.Writer
+	isTerminal bool
+}
+
+func NewTerminalSink(f *os.File) *TerminalSink {
+	isTerminal := false
+	if stat, err := f.Stat(); err == nil {
+		isTerminal = stat.Mode()&os.ModeCharDevice != 0
+	}
+	return &TerminalSink{
+		w:          f,
+		isTerminal: isTerminal,
+	}
+}
+
+func (s *TerminalSink) Handle(e *Event) {
+	elapsed := round(e.Elapsed)
+	switch e.Status {
+	case StatusStart:
+		if s.isTerminal {
+			fmt.Fprintf(s.w, "\r\033[K[%s] ...", e.Phase)
+		}
+	case StatusUpdate:
+		if s.isTerminal {
+			fmt.Fprintf(s.w, "\r\033[K[%s] %s (%d, %s)", e.Phase, e.Message, e.Count, elapsed)
+		}
+	case StatusDone:
+		if s.isTerminal {
+			fmt.Fprint(s.w, "\r\033[K")
+		}
+		fmt.Fprintf(s.w, "[%s] done: %d in %s\n", e.Phase, e.Count, elapsed)
+	}
+}
+
+func (s *TerminalSink) Close() error {
+	return nil
+}
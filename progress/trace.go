@@ -0,0 +1,86 @@
+package progress
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// TraceSink records the events and writes them as a JSON trace file on Close. The file is in
+// the Trace Event Format, so it can be opened by chrome://tracing or https://ui.perfetto.dev.
+type TraceSink struct {
+	filename string
+	mu       sync.Mutex
+	starts   map[string][]*Event
+	events   []*traceEvent
+	base     *Event
+}
+
+type traceEvent struct {
+	Name  string                 `json:"name"`
+	Phase string                 `json:"ph"`
+	Ts    int64                  `json:"ts"`
+	Dur   int64                  `json:"dur,omitempty"`
+	Pid   int                    `json:"pid"`
+	Tid   int                    `json:"tid"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+func NewTraceSink(filename string) *TraceSink {
+	return &TraceSink{
+		filename: filename,
+		starts:   make(map[string][]*Event),
+	}
+}
+
+func (s *TraceSink) Handle(e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.base == nil {
+		s.base = e
+	}
+	ts := e.Time.Sub(s.base.Time).Microseconds()
+	switch e.Status {
+	case StatusStart:
+		s.starts[e.Phase] = append(s.starts[e.Phase], e)
+	case StatusUpdate:
+		s.events = append(s.events, &traceEvent{
+			Name:  e.Phase,
+			Phase: "i",
+			Ts:    ts,
+			Pid:   1,
+			Tid:   1,
+			Args:  map[string]interface{}{"count": e.Count, "message": e.Message},
+		})
+	case StatusDone:
+		starts := s.starts[e.Phase]
+		if len(starts) == 0 {
+			return
+		}
+		start := starts[len(starts)-1]
+		s.starts[e.Phase] = starts[:len(starts)-1]
+		s.events = append(s.events, &traceEvent{
+			Name:  e.Phase,
+			Phase: "X",
+			Ts:    start.Time.Sub(s.base.Time).Microseconds(),
+			Dur:   e.Time.Sub(start.Time).Microseconds(),
+			Pid:   1,
+			Tid:   1,
+			Args:  map[string]interface{}{"count": e.Count, "peak_heap": e.Peak},
+		})
+	}
+}
+
+func (s *TraceSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.MarshalIndent(map[string]interface{}{"traceEvents": s.events}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.filename), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.filename, data, 0644)
+}
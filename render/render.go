@@ -17,4 +17,6 @@ type Edge struct {
 	To     int    `json:"target"`
 	Name   string `json:"name"`
 	Detail string `json:"detail"`
+	// Skip tells the edge is only on flows skipping layers
+	Skip bool `json:"skip,omitempty"`
 }
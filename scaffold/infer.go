@@ -0,0 +1,262 @@
+package scaffold
+
+import (
+	"fmt"
+	"github.com/laindream/go-callflow-vis/ir"
+	"github.com/laindream/go-callflow-vis/util"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Violation is a pair of packages with calls against the inferred layering, i.e. from a package
+// to one in the same or a previous layer.
+type Violation struct {
+	CallerPackage string
+	CalleePackage string
+	// From and To are the layers of the packages
+	From  int
+	To    int
+	Calls []*ir.Edge
+}
+
+// Infer condenses cg to the packages of its funcs and layers them by the calls between them. The
+// cycles between packages, i.e. their strongly connected components, are broken at the calls
+// against the order of their packages, see orderClusters, and every package is ranked by the
+// longest call path to it from the entry packages. The packages of a rank form a layer, the calls
+// which do not go to a later layer are reported as violations.
+func Infer(cg *ir.Callgraph, modules []string) *Proposal {
+	p := &Proposal{
+		Modules:  modules,
+		Inferred: true,
+		pkgFuncs: make(map[string]int),
+	}
+	for _, n := range cg.Nodes {
+		if n.Func == nil {
+			continue
+		}
+		pkg, _, _ := util.ParseFuncName(n.Func.Name)
+		p.pkgFuncs[pkg]++
+	}
+	pkgs := make([]*Cluster, 0, len(p.pkgFuncs))
+	pkgClusters := make(map[string]*Cluster)
+	for pkg, _ := range p.pkgFuncs {
+		c := &Cluster{Name: pkg, Packages: []string{pkg}, Funcs: p.pkgFuncs[pkg]}
+		pkgs = append(pkgs, c)
+		pkgClusters[pkg] = c
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].Name < pkgs[j].Name
+	})
+	p.setCalls(cg, pkgClusters)
+	broken := make(map[*Cluster]map[*Cluster]bool)
+	for _, scc := range p.getSCCs(pkgs) {
+		if len(scc) < 2 {
+			continue
+		}
+		pos := make(map[*Cluster]int)
+		for i, c := range p.orderClusters(scc) {
+			pos[c] = i
+		}
+		for _, caller := range scc {
+			for callee, _ := range p.calls[caller] {
+				if j, ok := pos[callee]; ok && j < pos[caller] {
+					if broken[caller] == nil {
+						broken[caller] = make(map[*Cluster]bool)
+					}
+					broken[caller][callee] = true
+				}
+			}
+		}
+	}
+	ranks := p.getLongestPathRanks(pkgs, broken)
+	layerOf := make(map[string]*Cluster)
+	for _, c := range pkgs {
+		if p.getCallsOut(c, nil) == 0 && p.getCallsIn(c, nil) == 0 {
+			c.Name = getLayerName(c.Packages)
+			p.Isolated = append(p.Isolated, c)
+			continue
+		}
+		for len(p.Layers) <= ranks[c] {
+			p.Layers = append(p.Layers, &Cluster{rank: len(p.Layers)})
+		}
+		layer := p.Layers[ranks[c]]
+		layer.Packages = append(layer.Packages, c.Name)
+		layer.Funcs += c.Funcs
+		layerOf[c.Name] = layer
+	}
+	for _, layer := range p.Layers {
+		layer.Name = getLayerName(layer.Packages)
+	}
+	violations := make(map[string]*Violation)
+	forEachCall(cg, func(e *ir.Edge, callerPkg, calleePkg string) {
+		caller, callee := layerOf[callerPkg], layerOf[calleePkg]
+		if callerPkg == calleePkg || caller == nil || callee == nil || callee.rank > caller.rank {
+			return
+		}
+		key := callerPkg + " " + calleePkg
+		v, ok := violations[key]
+		if !ok {
+			v = &Violation{CallerPackage: callerPkg, CalleePackage: calleePkg, From: caller.rank, To: callee.rank}
+			violations[key] = v
+			p.Violations = append(p.Violations, v)
+		}
+		v.Calls = append(v.Calls, e)
+	})
+	sort.Slice(p.Violations, func(i, j int) bool {
+		vi, vj := p.Violations[i], p.Violations[j]
+		if vi.From != vj.From {
+			return vi.From < vj.From
+		}
+		if vi.CallerPackage != vj.CallerPackage {
+			return vi.CallerPackage < vj.CallerPackage
+		}
+		return vi.CalleePackage < vj.CalleePackage
+	})
+	for _, v := range p.Violations {
+		sort.Slice(v.Calls, func(i, j int) bool {
+			return v.Calls[i].ReadableString() < v.Calls[j].ReadableString()
+		})
+	}
+	p.setCalls(cg, layerOf)
+	return p
+}
+
+// getSCCs returns the strongly connected components of the clusters by the calls between them,
+// by the algorithm of Tarjan.
+func (p *Proposal) getSCCs(clusters []*Cluster) [][]*Cluster {
+	index := make(map[*Cluster]int)
+	low := make(map[*Cluster]int)
+	onStack := make(map[*Cluster]bool)
+	stack := make([]*Cluster, 0)
+	sccs := make([][]*Cluster, 0)
+	var connect func(c *Cluster)
+	connect = func(c *Cluster) {
+		index[c] = len(index)
+		low[c] = index[c]
+		stack = append(stack, c)
+		onStack[c] = true
+		for _, callee := range p.getCallees(c) {
+			if _, ok := index[callee]; !ok {
+				connect(callee)
+				if low[callee] < low[c] {
+					low[c] = low[callee]
+				}
+			} else if onStack[callee] && index[callee] < low[c] {
+				low[c] = index[callee]
+			}
+		}
+		if low[c] != index[c] {
+			return
+		}
+		scc := make([]*Cluster, 0)
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			scc = append(scc, top)
+			if top == c {
+				break
+			}
+		}
+		sccs = append(sccs, scc)
+	}
+	for _, c := range clusters {
+		if _, ok := index[c]; !ok {
+			connect(c)
+		}
+	}
+	return sccs
+}
+
+// getLongestPathRanks ranks the clusters by the longest path to them by the calls which are not
+// broken, which leave no cycles.
+func (p *Proposal) getLongestPathRanks(clusters []*Cluster, broken map[*Cluster]map[*Cluster]bool) map[*Cluster]int {
+	inDegrees := make(map[*Cluster]int)
+	for _, c := range clusters {
+		for _, callee := range p.getCallees(c) {
+			if !broken[c][callee] {
+				inDegrees[callee]++
+			}
+		}
+	}
+	ranks := make(map[*Cluster]int)
+	queue := make([]*Cluster, 0)
+	for _, c := range clusters {
+		if inDegrees[c] == 0 {
+			queue = append(queue, c)
+		}
+	}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		for _, callee := range p.getCallees(c) {
+			if broken[c][callee] {
+				continue
+			}
+			if ranks[c]+1 > ranks[callee] {
+				ranks[callee] = ranks[c] + 1
+			}
+			inDegrees[callee]--
+			if inDegrees[callee] == 0 {
+				queue = append(queue, callee)
+			}
+		}
+	}
+	return ranks
+}
+
+// getCallees returns the clusters called by c by name.
+func (p *Proposal) getCallees(c *Cluster) []*Cluster {
+	callees := make([]*Cluster, 0, len(p.calls[c]))
+	for callee, _ := range p.calls[c] {
+		callees = append(callees, callee)
+	}
+	sort.Slice(callees, func(i, j int) bool {
+		return callees[i].Name < callees[j].Name
+	})
+	return callees
+}
+
+// getLayerName names a layer by the last path elements of its packages.
+func getLayerName(pkgs []string) string {
+	names := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		names = append(names, path.Base(pkg))
+	}
+	if len(names) > 3 {
+		return fmt.Sprintf("%s+%d more", strings.Join(names[:2], "+"), len(names)-2)
+	}
+	return strings.Join(names, "+")
+}
+
+// WriteViolations writes the calls of the violations as csv.
+func (p *Proposal) WriteViolations(filename string, separator string) error {
+	if separator == "" {
+		separator = ","
+	}
+	t := fmt.Sprintf("%s%s%s%s%s%s%s%s%s", "\"FromLayer\"", separator, "\"ToLayer\"", separator,
+		"\"Caller\"", separator, "\"Callee\"", separator, "\"Site\"\n")
+	for _, v := range p.Violations {
+		for _, e := range v.Calls {
+			site := ""
+			if e.Site != nil {
+				site = e.Site.Name
+			}
+			t += fmt.Sprintf("%d%s%d%s%s%s%s%s%s", v.From, separator, v.To, separator,
+				"\""+util.Escape(e.Caller.Func.Name)+"\"", separator,
+				"\""+util.Escape(e.Callee.Func.Name)+"\"", separator, "\""+util.Escape(site)+"\"")
+			t += "\n"
+		}
+	}
+	return util.WriteToFile(t, filename)
+}
+
+// GetViolationCalls returns the number of calls against the layering.
+func (p *Proposal) GetViolationCalls() int {
+	count := 0
+	for _, v := range p.Violations {
+		count += len(v.Calls)
+	}
+	return count
+}
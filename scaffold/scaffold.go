@@ -0,0 +1,359 @@
+package scaffold
+
+import (
+	"github.com/laindream/go-callflow-vis/config"
+	"github.com/laindream/go-callflow-vis/ir"
+	"github.com/laindream/go-callflow-vis/util"
+	"sort"
+	"strings"
+)
+
+// conventions are the clusters of packages by naming convention, in the usual order of calls.
+var conventions = []struct {
+	name     string
+	keywords []string
+}{
+	{"api", []string{"api", "apis", "gateway", "router", "routes", "rest", "http", "rpc", "grpc", "transport", "endpoint", "endpoints"}},
+	{"handler", []string{"handler", "handlers", "controller", "controllers", "server", "web"}},
+	{"service", []string{"service", "services", "svc", "usecase", "usecases", "biz", "logic", "app"}},
+	{"repo", []string{"repo", "repos", "repository", "repositories", "store", "stores", "storage"}},
+	{"dao", []string{"dao", "daos", "db", "mapper", "mappers", "persistence"}},
+}
+
+// utilityNames are packages called from everywhere, which are left out of the layers clustered
+// by directory.
+var utilityNames = map[string]bool{
+	"util": true, "utils": true, "common": true, "helper": true, "helpers": true, "errors": true,
+	"log": true, "logger": true, "config": true, "conf": true, "constant": true, "constants": true,
+}
+
+// Cluster is a set of packages proposed as a layer.
+type Cluster struct {
+	Name     string
+	Packages []string
+	Funcs    int
+	// rank orders clusters with calls in both directions, the conventional order first
+	rank int
+}
+
+// Proposal is a layered config proposed from the package structure and the callgraph.
+type Proposal struct {
+	Modules []string
+	// Layers are ordered by the direction of the calls between them
+	Layers []*Cluster
+	// Isolated are clusters without calls to or from the other ones
+	Isolated []*Cluster
+	// Unassigned are the packages of the modules in no cluster
+	Unassigned []string
+	// ByConvention tells the clusters are by naming convention, by top level directory otherwise
+	ByConvention bool
+	// Inferred tells the layers are inferred from the calls between the packages, see Infer
+	Inferred bool
+	// Violations are the calls against the inferred layers
+	Violations []*Violation
+	// Base is the config the callgraph is filtered by, its package_prefix, focus, ignore and builds
+	// are kept, the focus on the modules is proposed if nil
+	Base     *config.Config
+	pkgFuncs map[string]int
+	calls    map[*Cluster]map[*Cluster]int
+}
+
+// Propose clusters the packages of the modules by naming convention, or by their top level
+// directory if less than two conventional clusters are found, and orders the clusters by the
+// direction of the calls between them in cg.
+func Propose(cg *ir.Callgraph, modules []string) *Proposal {
+	p := &Proposal{
+		Modules:  modules,
+		pkgFuncs: make(map[string]int),
+	}
+	for _, n := range cg.Nodes {
+		if n.Func == nil {
+			continue
+		}
+		pkg, _, _ := util.ParseFuncName(n.Func.Name)
+		if p.getModule(pkg) != "" {
+			p.pkgFuncs[pkg]++
+		}
+	}
+	pkgs := make([]string, 0, len(p.pkgFuncs))
+	for pkg, _ := range p.pkgFuncs {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	clusters, pkgClusters := p.clusterByConvention(pkgs)
+	p.ByConvention = len(clusters) >= 2
+	if !p.ByConvention {
+		clusters, pkgClusters = p.clusterByDirectory(pkgs)
+	}
+	for _, pkg := range pkgs {
+		if c, ok := pkgClusters[pkg]; ok {
+			c.Funcs += p.pkgFuncs[pkg]
+			continue
+		}
+		p.Unassigned = append(p.Unassigned, pkg)
+	}
+	p.setCalls(cg, pkgClusters)
+	connected := make([]*Cluster, 0)
+	for _, c := range clusters {
+		if p.getCallsOut(c, nil) == 0 && p.getCallsIn(c, nil) == 0 {
+			p.Isolated = append(p.Isolated, c)
+			continue
+		}
+		connected = append(connected, c)
+	}
+	p.Layers = p.mergeUncalled(p.orderClusters(connected))
+	return p
+}
+
+// setCalls counts the calls in cg between the clusters of the packages.
+func (p *Proposal) setCalls(cg *ir.Callgraph, pkgClusters map[string]*Cluster) {
+	p.calls = make(map[*Cluster]map[*Cluster]int)
+	forEachCall(cg, func(e *ir.Edge, callerPkg, calleePkg string) {
+		caller, ok := pkgClusters[callerPkg]
+		if !ok {
+			return
+		}
+		callee, ok := pkgClusters[calleePkg]
+		if !ok || callee == caller {
+			return
+		}
+		if p.calls[caller] == nil {
+			p.calls[caller] = make(map[*Cluster]int)
+		}
+		p.calls[caller][callee]++
+	})
+}
+
+// forEachCall calls f with the edges of cg and the packages of their caller and callee.
+func forEachCall(cg *ir.Callgraph, f func(e *ir.Edge, callerPkg, calleePkg string)) {
+	for _, n := range cg.Nodes {
+		if n.Func == nil {
+			continue
+		}
+		callerPkg, _, _ := util.ParseFuncName(n.Func.Name)
+		for _, e := range n.Out {
+			if e.Callee == nil || e.Callee.Func == nil {
+				continue
+			}
+			calleePkg, _, _ := util.ParseFuncName(e.Callee.Func.Name)
+			f(e, callerPkg, calleePkg)
+		}
+	}
+}
+
+// mergeUncalled merges the layers not called by the layers above into the previous one, e.g. two
+// entry points, as the flow needs calls between subsequent layers.
+func (p *Proposal) mergeUncalled(layers []*Cluster) []*Cluster {
+	merged := make([]*Cluster, 0, len(layers))
+	for _, c := range layers {
+		calls := 0
+		for _, prev := range merged {
+			calls += p.calls[prev][c]
+		}
+		if len(merged) == 0 || calls > 0 {
+			merged = append(merged, c)
+			continue
+		}
+		last := merged[len(merged)-1]
+		last.Name = last.Name + "/" + c.Name
+		last.Packages = append(last.Packages, c.Packages...)
+		last.Funcs += c.Funcs
+		for callee, n := range p.calls[c] {
+			if p.calls[last] == nil {
+				p.calls[last] = make(map[*Cluster]int)
+			}
+			p.calls[last][callee] += n
+		}
+		for caller, _ := range p.calls {
+			if n := p.calls[caller][c]; n > 0 {
+				p.calls[caller][last] += n
+			}
+		}
+		delete(p.calls, c)
+		for caller, _ := range p.calls {
+			delete(p.calls[caller], c)
+		}
+		delete(p.calls[last], last)
+	}
+	return merged
+}
+
+// GetCalls returns the number of calls from the funcs of one cluster to the ones of another.
+func (p *Proposal) GetCalls(from, to *Cluster) int {
+	return p.calls[from][to]
+}
+
+// GetBackCalls returns the number of calls from a layer to a previous one.
+func (p *Proposal) GetBackCalls() int {
+	count := 0
+	for i, _ := range p.Layers {
+		for j := 0; j < i; j++ {
+			count += p.calls[p.Layers[i]][p.Layers[j]]
+		}
+	}
+	return count
+}
+
+func (p *Proposal) getModule(pkg string) string {
+	for _, m := range p.Modules {
+		if pkg == m || strings.HasPrefix(pkg, m+"/") {
+			return m
+		}
+	}
+	return ""
+}
+
+// getRelPath returns the path of the package in its module, empty for the module root.
+func (p *Proposal) getRelPath(pkg string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(pkg, p.getModule(pkg)), "/")
+}
+
+func (p *Proposal) clusterByConvention(pkgs []string) ([]*Cluster, map[string]*Cluster) {
+	clusters := make([]*Cluster, len(conventions))
+	pkgClusters := make(map[string]*Cluster)
+	for _, pkg := range pkgs {
+		// the deepest element decides, e.g. service/repo is a repo
+		elems := strings.Split(p.getRelPath(pkg), "/")
+		for i := len(elems) - 1; i >= 0; i-- {
+			k := getConvention(elems[i])
+			if k < 0 {
+				continue
+			}
+			if clusters[k] == nil {
+				clusters[k] = &Cluster{Name: conventions[k].name, rank: k}
+			}
+			clusters[k].Packages = append(clusters[k].Packages, pkg)
+			pkgClusters[pkg] = clusters[k]
+			break
+		}
+	}
+	found := make([]*Cluster, 0)
+	for _, c := range clusters {
+		if c != nil {
+			found = append(found, c)
+		}
+	}
+	return found, pkgClusters
+}
+
+// getConvention returns the index of the convention the path element is named by, e.g.
+// "handler", "user_handler" or "handler-v2", -1 if none.
+func getConvention(elem string) int {
+	elem = strings.ToLower(elem)
+	for k, c := range conventions {
+		for _, keyword := range c.keywords {
+			if elem == keyword ||
+				strings.HasSuffix(elem, "_"+keyword) || strings.HasSuffix(elem, "-"+keyword) ||
+				strings.HasPrefix(elem, keyword+"_") || strings.HasPrefix(elem, keyword+"-") {
+				return k
+			}
+		}
+	}
+	return -1
+}
+
+func (p *Proposal) clusterByDirectory(pkgs []string) ([]*Cluster, map[string]*Cluster) {
+	clusters := make([]*Cluster, 0)
+	byName := make(map[string]*Cluster)
+	pkgClusters := make(map[string]*Cluster)
+	for _, pkg := range pkgs {
+		name := getTopLevelName(p.getRelPath(pkg))
+		if utilityNames[name] {
+			continue
+		}
+		c, ok := byName[name]
+		if !ok {
+			c = &Cluster{Name: name, rank: len(conventions)}
+			byName[name] = c
+			clusters = append(clusters, c)
+		}
+		c.Packages = append(c.Packages, pkg)
+		pkgClusters[pkg] = c
+	}
+	return clusters, pkgClusters
+}
+
+// getTopLevelName returns the first element of the path in the module which is no container like
+// internal or pkg, main for the module root.
+func getTopLevelName(relPath string) string {
+	elems := strings.Split(relPath, "/")
+	for len(elems) > 1 && (elems[0] == "internal" || elems[0] == "pkg") {
+		elems = elems[1:]
+	}
+	if elems[0] == "" || elems[0] == "internal" || elems[0] == "pkg" {
+		return "main"
+	}
+	return elems[0]
+}
+
+func (p *Proposal) getCallsOut(c *Cluster, among map[*Cluster]bool) int {
+	count := 0
+	for callee, n := range p.calls[c] {
+		if among == nil || among[callee] {
+			count += n
+		}
+	}
+	return count
+}
+
+func (p *Proposal) getCallsIn(c *Cluster, among map[*Cluster]bool) int {
+	count := 0
+	for caller, _ := range p.calls {
+		if among == nil || among[caller] {
+			count += p.calls[caller][c]
+		}
+	}
+	return count
+}
+
+// orderClusters orders the clusters so that most calls go forward, by the greedy heuristic of
+// Eades, Lin and Smyth for the feedback arc set: sinks go last, sources first, and otherwise the
+// cluster calling the most more than it is called. Ties keep the conventional order.
+func (p *Proposal) orderClusters(clusters []*Cluster) []*Cluster {
+	sort.SliceStable(clusters, func(i, j int) bool {
+		if clusters[i].rank != clusters[j].rank {
+			return clusters[i].rank < clusters[j].rank
+		}
+		return clusters[i].Name < clusters[j].Name
+	})
+	remaining := make(map[*Cluster]bool)
+	for _, c := range clusters {
+		remaining[c] = true
+	}
+	head, tail := make([]*Cluster, 0), make([]*Cluster, 0)
+	remove := func(c *Cluster) {
+		delete(remaining, c)
+	}
+	for len(remaining) > 0 {
+		var sink, source, best *Cluster
+		bestDelta := 0
+		for _, c := range clusters {
+			if !remaining[c] {
+				continue
+			}
+			out, in := p.getCallsOut(c, remaining), p.getCallsIn(c, remaining)
+			if out == 0 {
+				// the last sink in the conventional order
+				sink = c
+			}
+			if in == 0 && source == nil {
+				source = c
+			}
+			if best == nil || out-in > bestDelta {
+				best, bestDelta = c, out-in
+			}
+		}
+		switch {
+		case source != nil:
+			head = append(head, source)
+			remove(source)
+		case sink != nil:
+			tail = append([]*Cluster{sink}, tail...)
+			remove(sink)
+		default:
+			head = append(head, best)
+			remove(best)
+		}
+	}
+	return append(head, tail...)
+}
@@ -0,0 +1,213 @@
+package scaffold
+
+import (
+	"fmt"
+	"github.com/laindream/go-callflow-vis/mode"
+	"io"
+	"strings"
+)
+
+// WriteTOML writes the proposal as a commented config in the shape of example.toml. source
+// describes what it is generated from, e.g. the command line.
+func (p *Proposal) WriteTOML(w io.Writer, source string) error {
+	sb := &strings.Builder{}
+	printf := func(format string, a ...interface{}) {
+		_, _ = fmt.Fprintf(sb, format, a...)
+	}
+	printf("# generated by %s\n", source)
+	printf("# review the layers before use, see example.toml for all options\n\n")
+	if p.Base != nil {
+		p.writeBase(printf)
+	} else {
+		p.writeModuleFocus(printf)
+	}
+	switch {
+	case p.Inferred:
+		printf("# the layers are inferred from the calls between the packages: the cycles are broken at the calls\n")
+		printf("# against the order of their packages, and each package is ranked by the longest call path to it.\n")
+		if len(p.Violations) > 0 {
+			printf("# %d calls in %d package pairs go to the same or a previous layer, see the violations report:\n",
+				p.GetViolationCalls(), len(p.Violations))
+			for _, v := range p.Violations {
+				printf("#     %s -> %s (layer %d -> %d, %d calls)\n", v.CallerPackage, v.CalleePackage, v.From, v.To, len(v.Calls))
+			}
+		}
+	default:
+		clustering := "by the top level directory of the packages"
+		if p.ByConvention {
+			clustering = "by the naming convention of the packages"
+		}
+		printf("# the layers are clustered %s, and ordered by the direction of the calls between them.\n", clustering)
+		if back := p.GetBackCalls(); back > 0 {
+			printf("# %d calls go from a layer to a previous one.\n", back)
+		}
+	}
+	if len(p.Layers) < 2 {
+		printf("# less than 2 layers are found, add layers before use.\n")
+	}
+	for i, c := range p.Layers {
+		printf("\n")
+		if i > 0 {
+			calls := 0
+			for _, prev := range p.Layers[:i] {
+				calls += p.GetCalls(prev, c)
+			}
+			printf("# %d calls from the layers above\n", calls)
+		}
+		p.writeCluster(printf, c, "")
+	}
+	if len(p.Isolated) > 0 {
+		printf("\n# clusters without calls to or from the layers above\n")
+		for _, c := range p.Isolated {
+			p.writeCluster(printf, c, "# ")
+		}
+	}
+	if len(p.Unassigned) > 0 {
+		printf("\n# packages in no layer:\n")
+		for _, pkg := range p.Unassigned {
+			printf("#     %s (%d funcs)\n", pkg, p.pkgFuncs[pkg])
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (p *Proposal) writeModuleFocus(printf func(format string, a ...interface{})) {
+	printf("# package_prefix is for trimming the function name in graph for human readability\n")
+	if len(p.Modules) == 1 {
+		printf("package_prefix = \"${module}/\"\n\n")
+	} else {
+		printf("# package_prefix = \"\"\n\n")
+	}
+	p.writeVars(printf)
+	printf("# focus is for filtering the functions to be included in the graph, the packages of the module\n")
+	rules := make([]string, 0)
+	for _, m := range p.Modules {
+		rules = append(rules, p.getPackageRule(m), p.getPackageRule(m+"/*"))
+	}
+	printf("[[focus]]\nor = true\nrules = [%s]\n\n", strings.Join(rules, ", "))
+	printf("# ignore is for filtering the functions to be excluded in the graph\n")
+	printf("# [[ignore]]\n# rules = [{ type = \"icontain\", content = \"mock\" }]\n\n")
+}
+
+// writeVars writes the module var the package rules refer to if there is a single module.
+func (p *Proposal) writeVars(printf func(format string, a ...interface{})) {
+	if len(p.Modules) != 1 {
+		return
+	}
+	printf("# vars are substituted for ${name} in package_prefix and the content of the rules\n")
+	printf("[vars]\nmodule = %q\n\n", p.Modules[0])
+}
+
+// writeBase writes the settings of the base config, with its vars and templates resolved.
+func (p *Proposal) writeBase(printf func(format string, a ...interface{})) {
+	printf("# package_prefix is for trimming the function name in graph for human readability\n")
+	if p.Base.PackagePrefix != "" {
+		printf("package_prefix = %q\n\n", p.Base.PackagePrefix)
+	} else {
+		printf("# package_prefix = \"\"\n\n")
+	}
+	p.writeVars(printf)
+	printf("# focus is for filtering the functions to be included in the graph\n")
+	for _, m := range p.Base.Focus {
+		printf("[[focus]]\n%s\n", strings.Join(formatMode(m), "\n"))
+	}
+	printf("\n# ignore is for filtering the functions to be excluded in the graph\n")
+	for _, m := range p.Base.Ignore {
+		printf("[[ignore]]\n%s\n", strings.Join(formatMode(m), "\n"))
+	}
+	printf("\n")
+	if len(p.Base.Builds) == 0 {
+		return
+	}
+	printf("# build is one build configuration of the matrix, the callgraphs of all builds are merged\n")
+	for _, b := range p.Base.Builds {
+		printf("[[build]]\n")
+		if b.Name != "" {
+			printf("name = %q\n", b.Name)
+		}
+		if b.GOOS != "" {
+			printf("goos = %q\n", b.GOOS)
+		}
+		if b.GOARCH != "" {
+			printf("goarch = %q\n", b.GOARCH)
+		}
+		if len(b.Tags) > 0 {
+			printf("tags = %s\n", formatStrings(b.Tags))
+		}
+		if len(b.Env) > 0 {
+			printf("env = %s\n", formatStrings(b.Env))
+		}
+	}
+	printf("\n")
+}
+
+func (p *Proposal) writeCluster(printf func(format string, a ...interface{}), c *Cluster, comment string) {
+	printf("%s[[layer]]\n%sname = %q\n", comment, comment, c.Name)
+	for _, pkg := range c.Packages {
+		printf("# %d funcs in %s\n", p.pkgFuncs[pkg], pkg)
+		printf("%s[[layer.entities]]\n%sname = { rules = [%s] }\n", comment, comment, p.getPackageRule(pkg))
+	}
+}
+
+// getPackageRule returns the rule matching the funcs of the package, by the module var if there
+// is a single module.
+func (p *Proposal) getPackageRule(pkg string) string {
+	if len(p.Modules) == 1 && p.getModule(pkg) != "" {
+		pkg = "${module}" + strings.TrimPrefix(pkg, p.Modules[0])
+	}
+	return fmt.Sprintf("{ type = \"package\", content = %q }", pkg)
+}
+
+// formatMode returns the keys of the mode in TOML.
+func formatMode(m *mode.Mode) []string {
+	keys := make([]string, 0)
+	if m.OR {
+		keys = append(keys, "or = true")
+	}
+	if m.AND {
+		keys = append(keys, "and = true")
+	}
+	if m.Not {
+		keys = append(keys, "not = true")
+	}
+	return append(keys, fmt.Sprintf("rules = [%s]", formatRules(m.Rules)))
+}
+
+func formatRules(rules []mode.Rule) string {
+	formatted := make([]string, 0, len(rules))
+	for _, r := range rules {
+		keys := make([]string, 0)
+		if r.Exclude {
+			keys = append(keys, "exclude = true")
+		}
+		if r.Not {
+			keys = append(keys, "not = true")
+		}
+		if r.OR {
+			keys = append(keys, "or = true")
+		}
+		if r.AND {
+			keys = append(keys, "and = true")
+		}
+		if r.Type != "" {
+			keys = append(keys, fmt.Sprintf("type = %q", r.Type))
+		}
+		if r.Content != "" {
+			keys = append(keys, fmt.Sprintf("content = %q", r.Content))
+		}
+		if len(r.Rules) > 0 {
+			keys = append(keys, fmt.Sprintf("rules = [%s]", formatRules(r.Rules)))
+		}
+		formatted = append(formatted, "{ "+strings.Join(keys, ", ")+" }")
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func formatStrings(s []string) string {
+	quoted := make([]string, 0, len(s))
+	for _, e := range s {
+		quoted = append(quoted, fmt.Sprintf("%q", e))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
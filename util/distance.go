@@ -0,0 +1,55 @@
+package util
+
+// GetEditDistance returns the Levenshtein distance of a and b in runes.
+func GetEditDistance(a, b string) int {
+	return getEditDistance([]rune(a), []rune(b), false, false)
+}
+
+// GetPrefixEditDistance returns the least edit distance of p to a prefix of s.
+func GetPrefixEditDistance(p, s string) int {
+	return getEditDistance([]rune(p), []rune(s), false, true)
+}
+
+// GetSubstringEditDistance returns the least edit distance of p to a substring of s.
+func GetSubstringEditDistance(p, s string) int {
+	return getEditDistance([]rune(p), []rune(s), true, true)
+}
+
+// getEditDistance computes the distance of p to s row by row, with freeStart s may be entered
+// and with freeEnd left at any rune without cost.
+func getEditDistance(p, s []rune, freeStart, freeEnd bool) int {
+	row := make([]int, len(s)+1)
+	for j, _ := range row {
+		if !freeStart {
+			row[j] = j
+		}
+	}
+	for i := 1; i <= len(p); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(s); j++ {
+			cost := 1
+			if p[i-1] == s[j-1] {
+				cost = 0
+			}
+			next := minInt(minInt(row[j]+1, row[j-1]+1), prev+cost)
+			prev = row[j]
+			row[j] = next
+		}
+	}
+	if !freeEnd {
+		return row[len(s)]
+	}
+	least := row[0]
+	for _, d := range row {
+		least = minInt(least, d)
+	}
+	return least
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"strings"
+)
+
+// ParseFuncName splits a function name as printed by ssa into its package path, receiver type
+// name and function or method name, e.g. "(*example.com/a/b.T).M$1" into "example.com/a/b", "T"
+// and "M$1". Pointer receivers and type arguments are dropped, the receiver of functions is empty.
+func ParseFuncName(name string) (pkg, receiver, fn string) {
+	if strings.HasPrefix(name, "(") {
+		end := getClosingParen(name)
+		if end > 0 && end+1 < len(name) && name[end+1] == '.' {
+			recv := strings.TrimPrefix(removeTypeArgs(name[1:end]), "*")
+			pkg, receiver = splitQualifiedName(recv)
+			return pkg, receiver, removeTypeArgs(name[end+2:])
+		}
+	}
+	pkg, fn = splitQualifiedName(removeTypeArgs(name))
+	return pkg, "", fn
+}
+
+// splitQualifiedName splits "path/to/pkg.Name" at the last dot, which comes after the last slash
+// as names have no dots.
+func splitQualifiedName(name string) (string, string) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 || i < strings.LastIndex(name, "/") {
+		return "", name
+	}
+	return name[:i], name[i+1:]
+}
+
+func getClosingParen(name string) int {
+	depth := 0
+	for i, c := range name {
+		switch c {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+			if depth == 0 && c == ')' {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// removeTypeArgs removes the bracketed type arguments, e.g. "pkg.Map[int string]$1" to "pkg.Map$1".
+func removeTypeArgs(name string) string {
+	if !strings.Contains(name, "[") {
+		return name
+	}
+	sb := strings.Builder{}
+	depth := 0
+	for _, c := range name {
+		switch {
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case depth == 0:
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}